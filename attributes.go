@@ -0,0 +1,59 @@
+package s3batchstore
+
+import (
+	"maps"
+)
+
+// ObjectAttributes holds optional information about an object, provided when appending it to a TempFile.
+// The attributes are stored in its ObjectIndex, and therefore in the meta file, so they can be retrieved along with
+// the payload using FetchWithMetadata. They are never encrypted, even when the object payload is.
+type ObjectAttributes struct {
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// AppendOption allows to customize how a single object is appended to a TempFile.
+type AppendOption func(*appendOptions)
+
+// appendOptions holds the optional settings of an append. The zero value is a valid configuration.
+type appendOptions struct {
+	attributes ObjectAttributes
+}
+
+// WithObjectContentType sets the content type of the appended object in its ObjectAttributes.
+func WithObjectContentType(contentType string) AppendOption {
+	return func(o *appendOptions) {
+		o.attributes.ContentType = contentType
+	}
+}
+
+// WithObjectContentEncoding sets the content encoding of the appended object in its ObjectAttributes.
+func WithObjectContentEncoding(contentEncoding string) AppendOption {
+	return func(o *appendOptions) {
+		o.attributes.ContentEncoding = contentEncoding
+	}
+}
+
+// WithObjectMetadata adds the given key-value pairs to the metadata of the appended object in its ObjectAttributes.
+func WithObjectMetadata(metadata map[string]string) AppendOption {
+	return func(o *appendOptions) {
+		if o.attributes.Metadata == nil {
+			o.attributes.Metadata = make(map[string]string, len(metadata))
+		}
+		maps.Copy(o.attributes.Metadata, metadata)
+	}
+}
+
+// objectAttributes returns the attributes set by the options, or nil if there are none.
+func objectAttributes(opts []AppendOption) *ObjectAttributes {
+	var options appendOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.attributes.ContentType == "" && options.attributes.ContentEncoding == "" &&
+		len(options.attributes.Metadata) == 0 {
+		return nil
+	}
+	return &options.attributes
+}
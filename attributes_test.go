@@ -0,0 +1,52 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestFile_AppendWithAttributes(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	file, err := NewTempFile[string](testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	metadata := map[string]string{"source": "test"}
+	index, err := file.AppendAndReturnIndex("1", []byte("contents"),
+		WithObjectContentType("application/json"),
+		WithObjectContentEncoding("gzip"),
+		WithObjectMetadata(metadata),
+		WithObjectMetadata(map[string]string{"owner": "me"}),
+	)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.Attributes).To(Equal(&ObjectAttributes{
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		Metadata:        map[string]string{"source": "test", "owner": "me"},
+	}))
+	g.Expect(file.Indexes()["1"]).To(Equal(index))
+
+	// The metadata is copied, so changing the map doesn't affect the index
+	metadata["source"] = "changed"
+	g.Expect(file.Indexes()["1"].Attributes.Metadata["source"]).To(Equal("test"))
+
+	index, err = file.AppendReader("2", strings.NewReader("contents"), WithObjectContentType("text/plain"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.Attributes).To(Equal(&ObjectAttributes{ContentType: "text/plain"}))
+
+	// Without options, or with empty ones, no attributes are stored
+	index, err = file.AppendAndReturnIndex("3", []byte("contents"), WithObjectMetadata(nil))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.Attributes).To(BeNil())
+
+	// The attributes are stored in the meta file
+	metaBody, err := encodeMetaFile(&MetaFile[string]{Entries: file.Indexes()}, MetaFileV2, StringKeyCodec[string]())
+	g.Expect(err).ToNot(HaveOccurred())
+	metaFile, err := decodeMetaFile(bytes.NewReader(metaBody), StringKeyCodec[string]())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(metaFile.Entries).To(Equal(file.Indexes()))
+}
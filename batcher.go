@@ -0,0 +1,406 @@
+package s3batchstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BatchResult is the outcome of the upload of a file by a Batcher.
+type BatchResult[K comparable] struct {
+	FileKey string            // The key of the uploaded file
+	Indexes map[K]ObjectIndex // The indexes of all the objects in the file
+	// The older versions of the objects appended more than once, only with DuplicateKeepAll, see MetaFile.Versions
+	Versions map[K][]ObjectIndex
+	Err      error // Not nil if the file could not be uploaded, in which case the objects were lost
+}
+
+// Batcher accepts objects concurrently, appending them to a TempFile, and uploads that file in the background
+// once it reaches the configured size, count or age, delivering the resulting indexes to a callback.
+// K represents the type of IDs for the objects that will be uploaded.
+type Batcher[K comparable] struct {
+	batcherOptions
+	client   Client[K]
+	onUpload func(BatchResult[K])
+
+	mu       sync.Mutex
+	current  *batch[K]     // The file receiving the appends, created on the first Add
+	creating chan struct{} // Closed once the current file is created, nil if it's not being created
+	started  uint          // The number of appends started on the current file, to respect the max count
+	timer    *time.Timer   // Seals the current file when it reaches the max age
+	closed   bool
+
+	queue   chan *TempFile[K] // Sealed files waiting to be uploaded
+	sends   sync.WaitGroup    // The sealed files not sent to the queue yet, which must be sent before closing it
+	workers sync.WaitGroup
+	ctx     context.Context // Used for the uploads, cancelled if Close times out
+	cancel  context.CancelFunc
+}
+
+// batch is a file of a Batcher along with the appends in progress to it.
+type batch[K comparable] struct {
+	file    *TempFile[K]
+	appends sync.WaitGroup // The appends in progress, which must finish before uploading the file
+}
+
+// BatcherOption allows to customize the behaviour of a Batcher.
+type BatcherOption func(*batcherOptions)
+
+// batcherOptions holds the optional settings of a Batcher. The zero value is a valid configuration.
+type batcherOptions struct {
+	maxSize  uint64        // Upload the file once it has at least this many bytes
+	maxCount uint          // Upload the file once it has at least this many objects
+	maxAge   time.Duration // Upload the file once it is this old
+
+	tags              map[string]string
+	withMetaFile      bool
+	tempFileOpts      []TempFileOption
+	uploadOpts        []UploadOption
+	uploadConcurrency int           // How many files can be uploaded in parallel
+	uploadAttempts    int           // How many times to try to upload a file before giving up
+	uploadTimeout     time.Duration // Timeout of each upload attempt, no timeout if zero
+}
+
+const (
+	// defaultBatcherUploadAttempts is the default number of times a Batcher tries to upload a file
+	defaultBatcherUploadAttempts = 3
+	// batcherRetryBackoff is the wait before the first retry of a failed upload, it doubles after each attempt
+	batcherRetryBackoff = 100 * time.Millisecond
+	// batcherCleanupTimeout is the timeout to delete what a failed upload may have left behind
+	batcherCleanupTimeout = 30 * time.Second
+)
+
+// WithMaxSize makes the Batcher upload the current file once its size reaches size bytes.
+func WithMaxSize(size uint64) BatcherOption {
+	return func(o *batcherOptions) {
+		o.maxSize = size
+	}
+}
+
+// WithMaxCount makes the Batcher upload the current file once it holds count objects.
+func WithMaxCount(count uint) BatcherOption {
+	return func(o *batcherOptions) {
+		o.maxCount = count
+	}
+}
+
+// WithMaxAge makes the Batcher upload the current file once age has passed since its first object was added,
+// even if it didn't reach the max size or count.
+func WithMaxAge(age time.Duration) BatcherOption {
+	return func(o *batcherOptions) {
+		o.maxAge = age
+	}
+}
+
+// WithBatchTags sets the tags of the files created by the Batcher.
+func WithBatchTags(tags map[string]string) BatcherOption {
+	return func(o *batcherOptions) {
+		o.tags = tags
+	}
+}
+
+// WithBatchMetaFile makes the Batcher upload the meta file along with each file.
+func WithBatchMetaFile() BatcherOption {
+	return func(o *batcherOptions) {
+		o.withMetaFile = true
+	}
+}
+
+// WithBatchTempFileOptions sets the options used to create the files of the Batcher.
+func WithBatchTempFileOptions(opts ...TempFileOption) BatcherOption {
+	return func(o *batcherOptions) {
+		o.tempFileOpts = append(o.tempFileOpts, opts...)
+	}
+}
+
+// WithBatchUploadOptions sets the options used to upload the files of the Batcher.
+func WithBatchUploadOptions(opts ...UploadOption) BatcherOption {
+	return func(o *batcherOptions) {
+		o.uploadOpts = append(o.uploadOpts, opts...)
+	}
+}
+
+// WithBatchUploadConcurrency sets how many files can be uploaded in parallel. Defaults to 1.
+// When all the uploads are in progress, Add blocks until one of them finishes.
+func WithBatchUploadConcurrency(concurrency int) BatcherOption {
+	return func(o *batcherOptions) {
+		o.uploadConcurrency = concurrency
+	}
+}
+
+// WithBatchUploadAttempts sets how many times the Batcher tries to upload a file before reporting an error.
+// Defaults to 3.
+func WithBatchUploadAttempts(attempts int) BatcherOption {
+	return func(o *batcherOptions) {
+		o.uploadAttempts = attempts
+	}
+}
+
+// WithBatchUploadTimeout sets the timeout of each upload attempt. By default, there is no timeout.
+func WithBatchUploadTimeout(timeout time.Duration) BatcherOption {
+	return func(o *batcherOptions) {
+		o.uploadTimeout = timeout
+	}
+}
+
+// NewBatcher creates a Batcher that uses client to create and upload the files.
+// onUpload is called from a background goroutine after each file upload, successful or not, and must not call Add
+// or Flush, as they may block until an upload worker is available.
+// At least one of WithMaxSize, WithMaxCount or WithMaxAge should be provided, otherwise files are only uploaded
+// when calling Flush or Close.
+func NewBatcher[K comparable](client Client[K], onUpload func(BatchResult[K]), opts ...BatcherOption) *Batcher[K] {
+	options := batcherOptions{
+		uploadConcurrency: 1,
+		uploadAttempts:    defaultBatcherUploadAttempts,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Batcher[K]{
+		batcherOptions: options,
+		client:         client,
+		onUpload:       onUpload,
+		queue:          make(chan *TempFile[K]),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	for range max(options.uploadConcurrency, 1) {
+		b.workers.Go(b.uploadLoop)
+	}
+	return b
+}
+
+// Add appends the object to the current file, and queues the file for upload if it reached the max size or count.
+// It is safe to call Add concurrently, and the objects are compressed and encrypted in parallel.
+// opts are passed to the TempFile Append method.
+func (b *Batcher[K]) Add(id K, payload []byte, opts ...AppendOption) error {
+	current, full, err := b.startAppend()
+	if err != nil {
+		return err
+	}
+
+	// The file is not sealed until the append finishes, as TempFile is safe for concurrent use there's no need to
+	// hold the lock while appending
+	err = current.file.Append(id, payload, opts...)
+	full = full || (b.maxSize > 0 && current.file.Size() >= b.maxSize)
+	current.appends.Done()
+	if err != nil {
+		return err
+	}
+
+	if full {
+		b.sealIfCurrent(current)
+	}
+	return nil
+}
+
+// startAppend returns the current file, creating it if needed, and registers an append to it that must be
+// finished by calling appends.Done. It also returns whether the file reaches the max count with this append.
+func (b *Batcher[K]) startAppend() (*batch[K], bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.current == nil || (b.maxCount > 0 && b.started >= b.maxCount) {
+		switch {
+		case b.closed:
+			return nil, false, ErrBatcherClosed
+		case b.current != nil:
+			// The appends that filled the file didn't seal it yet, it's sent without holding the lock as it may block
+			sealed := b.sealLocked()
+			b.mu.Unlock()
+			b.enqueue(sealed)
+			b.mu.Lock()
+		case b.creating != nil:
+			// Another Add is creating the file
+			creating := b.creating
+			b.mu.Unlock()
+			<-creating
+			b.mu.Lock()
+		default:
+			if err := b.createLocked(); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if b.closed {
+		return nil, false, ErrBatcherClosed
+	}
+	b.current.appends.Add(1)
+	b.started++
+	return b.current, b.maxCount > 0 && b.started >= b.maxCount, nil
+}
+
+// createLocked creates the current file. b.mu must be held, and it is released while creating the file, which may
+// be slow, like when generating its data key with a KMS (see WithEncryption).
+func (b *Batcher[K]) createLocked() error {
+	creating := make(chan struct{})
+	b.creating = creating
+	b.mu.Unlock()
+	file, err := b.client.NewTempFile(b.tags, b.tempFileOpts...)
+	b.mu.Lock()
+	b.creating = nil
+	close(creating)
+
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	if b.closed {
+		_ = file.Close()
+		return ErrBatcherClosed
+	}
+	current := &batch[K]{file: file}
+	b.current = current
+	b.started = 0
+	if b.maxAge > 0 {
+		b.timer = time.AfterFunc(b.maxAge, func() { b.sealIfCurrent(current) })
+	}
+	return nil
+}
+
+// Flush queues the current file for upload, regardless of its size, count or age.
+// It doesn't wait for the upload to finish, but it blocks until an upload worker is available.
+func (b *Batcher[K]) Flush() {
+	b.mu.Lock()
+	var sealed *batch[K]
+	if !b.closed {
+		sealed = b.sealLocked()
+	}
+	b.mu.Unlock()
+
+	b.enqueue(sealed)
+}
+
+// Close uploads the current file, and waits for all the pending uploads to finish.
+// If ctx is done before that, the pending uploads are cancelled and the ctx error is returned right away, while the
+// cancelled uploads report their errors to the callback in the background. No more objects can be added after
+// calling Close.
+func (b *Batcher[K]) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBatcherClosed
+	}
+	b.closed = true
+	last := b.sealLocked()
+	b.mu.Unlock()
+
+	// No file is sealed once the batcher is closed, so it's safe to close the queue after sending the ones already
+	// sealed. This is done in the background, as it blocks until the appends in progress finish and a worker is
+	// available.
+	done := make(chan struct{})
+	go func() {
+		b.enqueue(last)
+		b.sends.Wait()
+		close(b.queue)
+		b.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		b.cancel()
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
+
+// sealIfCurrent queues the file for upload, unless it was already sealed.
+func (b *Batcher[K]) sealIfCurrent(current *batch[K]) {
+	b.mu.Lock()
+	var sealed *batch[K]
+	if b.current == current && !b.closed {
+		sealed = b.sealLocked()
+	}
+	b.mu.Unlock()
+
+	b.enqueue(sealed)
+}
+
+// sealLocked detaches the current file, so that the next Add creates a new one, and returns it, or nil if there is
+// no current file. The returned file must be passed to enqueue once b.mu is released. b.mu must be held.
+func (b *Batcher[K]) sealLocked() *batch[K] {
+	if b.current == nil {
+		return nil
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	sealed := b.current
+	b.current = nil
+	b.sends.Add(1)
+	return sealed
+}
+
+// enqueue waits for the appends in progress to a sealed file, and sends it to the queue, blocking until an upload
+// worker is available. It does nothing if sealed is nil. b.mu must not be held.
+func (b *Batcher[K]) enqueue(sealed *batch[K]) {
+	if sealed == nil {
+		return
+	}
+	defer b.sends.Done()
+	// The file is no longer current, so no new appends to it can start
+	sealed.appends.Wait()
+	b.queue <- sealed.file
+}
+
+// uploadLoop uploads the sealed files until the queue is closed.
+func (b *Batcher[K]) uploadLoop() {
+	for file := range b.queue {
+		err := b.upload(file)
+		if err != nil && !errors.Is(err, ErrAlreadyExists) {
+			// Try to clean up anything that might have been uploaded, like the data file without its meta file.
+			// The files that already existed were not written by the Batcher, so they are kept.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(b.ctx), batcherCleanupTimeout)
+			_ = b.client.DeleteFile(ctx, file)
+			cancel()
+		}
+		if b.onUpload != nil {
+			b.onUpload(BatchResult[K]{
+				FileKey:  file.Name(),
+				Indexes:  file.Indexes(),
+				Versions: file.olderVersions(),
+				Err:      err,
+			})
+		}
+		_ = file.Close()
+	}
+}
+
+// upload uploads the file, retrying with an exponential backoff if it fails.
+func (b *Batcher[K]) upload(file *TempFile[K]) error {
+	backoff := batcherRetryBackoff
+	var err error
+	for attempt := range max(b.uploadAttempts, 1) {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-b.ctx.Done():
+				return errors.Join(err, b.ctx.Err())
+			}
+		}
+
+		if err = b.uploadOnce(file); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// uploadOnce makes a single attempt to upload the file.
+func (b *Batcher[K]) uploadOnce(file *TempFile[K]) error {
+	ctx := b.ctx
+	if b.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.uploadTimeout)
+		defer cancel()
+	}
+	return b.client.UploadFile(ctx, file, b.withMetaFile, b.uploadOpts...)
+}
@@ -0,0 +1,352 @@
+package s3batchstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+// batchResults collects the results reported by a Batcher.
+type batchResults struct {
+	mu      sync.Mutex
+	results []BatchResult[string]
+}
+
+func (r *batchResults) onUpload(result BatchResult[string]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, result)
+}
+
+func (r *batchResults) get() []BatchResult[string] {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]BatchResult[string]{}, r.results...)
+}
+
+func TestBatcher_MaxCount(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+
+	// 5 objects with a max count of 2: 2 full files, and the last one uploaded on Close
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		g.Expect(input.Tagging).To(Equal(aws.String("retention-days=14")))
+		return &s3.PutObjectOutput{}, nil
+	}).Times(6)
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload,
+		WithMaxCount(2),
+		WithBatchTags(testTags),
+		WithBatchMetaFile(),
+		WithBatchUploadConcurrency(2),
+	)
+
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Go(func() {
+			g.Expect(b.Add(fmt.Sprint(i), []byte("payload"))).To(Succeed())
+		})
+	}
+	wg.Wait()
+	g.Expect(b.Close(context.Background())).To(Succeed())
+
+	uploaded := map[string]ObjectIndex{}
+	for _, result := range results.get() {
+		g.Expect(result.Err).ToNot(HaveOccurred())
+		g.Expect(len(result.Indexes)).To(BeNumerically("<=", 2))
+		for id, ind := range result.Indexes {
+			g.Expect(ind.File).To(Equal(result.FileKey))
+			uploaded[id] = ind
+		}
+	}
+	g.Expect(results.get()).To(HaveLen(3))
+	g.Expect(uploaded).To(HaveLen(5))
+
+	g.Expect(b.Add("6", []byte("payload"))).To(MatchError(ErrBatcherClosed))
+	g.Expect(b.Close(context.Background())).To(MatchError(ErrBatcherClosed))
+}
+
+func TestBatcher_MaxSizeAndAge(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil).Times(2)
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload,
+		WithMaxSize(10),
+		WithMaxAge(50*time.Millisecond),
+	)
+
+	// Reaching the max size uploads the file right away
+	g.Expect(b.Add("1", []byte("0123456789"))).To(Succeed())
+	g.Eventually(results.get).Should(HaveLen(1))
+	g.Expect(results.get()[0].Indexes).To(HaveKey("1"))
+
+	// A smaller file is uploaded once it's old enough
+	g.Expect(b.Add("2", []byte("01234"))).To(Succeed())
+	g.Consistently(results.get, 20*time.Millisecond).Should(HaveLen(1))
+	g.Eventually(results.get).Should(HaveLen(2))
+	g.Expect(results.get()[1].Indexes).To(HaveKey("2"))
+
+	// Nothing left to upload on Close
+	g.Expect(b.Close(context.Background())).To(Succeed())
+	g.Expect(results.get()).To(HaveLen(2))
+}
+
+func TestBatcher_Flush(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload)
+
+	// Flushing without objects doesn't upload anything
+	b.Flush()
+	g.Expect(b.Add("1", []byte("payload"))).To(Succeed())
+	b.Flush()
+	g.Eventually(results.get).Should(HaveLen(1))
+
+	g.Expect(b.Close(context.Background())).To(Succeed())
+	g.Expect(results.get()).To(HaveLen(1))
+}
+
+func TestBatcher_UploadError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+
+	// The first attempt fails and the second one succeeds for the first file, and all attempts fail for the second one
+	gomock.InOrder(
+		s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(nil, errors.New("s3 service error")),
+		s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil),
+		s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(nil, errors.New("s3 service error")).Times(2),
+		s3Mock.EXPECT().DeleteObjects(gomock.Any(), gomock.Any()).Return(&s3.DeleteObjectsOutput{}, nil),
+	)
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload, WithMaxCount(1), WithBatchUploadAttempts(2))
+
+	g.Expect(b.Add("1", []byte("payload"))).To(Succeed())
+	g.Expect(b.Add("2", []byte("payload"))).To(Succeed())
+	g.Expect(b.Close(context.Background())).To(Succeed())
+
+	g.Expect(results.get()).To(HaveLen(2))
+	g.Expect(results.get()[0].Err).ToNot(HaveOccurred())
+	g.Expect(results.get()[0].Indexes).To(HaveKey("1"))
+	g.Expect(results.get()[1].Err).To(MatchError("failed to upload data file to s3: s3 service error"))
+	g.Expect(results.get()[1].Indexes).To(HaveKey("2"))
+}
+
+func TestBatcher_CloseTimeout(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+
+	// The upload hangs until its context is cancelled
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	// The cleanup is slow, but Close doesn't wait for it
+	cleanup := make(chan struct{})
+	s3Mock.EXPECT().DeleteObjects(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, _ *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+		<-cleanup
+		return &s3.DeleteObjectsOutput{}, nil
+	})
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload)
+	g.Expect(b.Add("1", []byte("payload"))).To(Succeed())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	g.Expect(b.Close(ctx)).To(MatchError(context.DeadlineExceeded))
+	g.Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+	// The cancelled upload is reported in the background, after the cleanup
+	close(cleanup)
+	g.Eventually(results.get).Should(HaveLen(1))
+	g.Expect(results.get()[0].Err).To(MatchError(context.Canceled))
+}
+
+func TestBatcher_CloseWhileSealing(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+
+	// The uploads hang until their context is cancelled
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}).AnyTimes()
+	s3Mock.EXPECT().DeleteObjects(gomock.Any(), gomock.Any()).Return(&s3.DeleteObjectsOutput{}, nil).AnyTimes()
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload, WithMaxCount(1))
+
+	// The first file keeps the only worker busy, so the second one can't be queued and its Add blocks
+	g.Expect(b.Add("1", []byte("payload"))).To(Succeed())
+	added := make(chan error)
+	go func() { added <- b.Add("2", []byte("payload")) }()
+	g.Consistently(added, 20*time.Millisecond).ShouldNot(Receive())
+
+	// Neither the blocked Add nor a Flush hold the lock that Close needs
+	b.Flush()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	g.Expect(b.Close(ctx)).To(MatchError(context.DeadlineExceeded))
+	g.Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+	// Both files are reported as cancelled once the workers are free
+	g.Eventually(added).Should(Receive(BeNil()))
+	g.Eventually(results.get).Should(HaveLen(2))
+	for _, result := range results.get() {
+		g.Expect(result.Err).To(MatchError(context.Canceled))
+	}
+}
+
+// blockingKeyProvider is a KeyProvider that waits for release before generating the data keys.
+type blockingKeyProvider struct {
+	KeyProvider
+	release chan struct{}
+}
+
+func (p blockingKeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	<-p.release
+	return p.KeyProvider.GenerateDataKey(ctx)
+}
+
+func TestBatcher_SlowTempFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+
+	kp, err := NewStaticKeyProvider(testMasterKey)
+	g.Expect(err).ToNot(HaveOccurred())
+	release := make(chan struct{})
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload,
+		WithBatchTempFileOptions(WithEncryption(blockingKeyProvider{KeyProvider: kp, release: release})))
+
+	// The file is created without holding the lock, so a slow data key doesn't block the other calls
+	added := make(chan error, 2)
+	for i := range 2 {
+		go func() { added <- b.Add(fmt.Sprint(i), []byte("payload")) }()
+	}
+	g.Consistently(added, 20*time.Millisecond).ShouldNot(Receive())
+	b.Flush()
+	g.Expect(b.Close(context.Background())).To(Succeed())
+
+	// The file created after closing the batcher is discarded
+	close(release)
+	g.Eventually(added).Should(Receive(MatchError(ErrBatcherClosed)))
+	g.Eventually(added).Should(Receive(MatchError(ErrBatcherClosed)))
+	g.Expect(results.get()).To(BeEmpty())
+}
+
+func TestBatcher_AlreadyExists(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+
+	// A different file already exists, so it's not deleted (there's no DeleteObjects call)
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(nil, &smithy.GenericAPIError{Code: "PreconditionFailed"})
+	s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(&s3.HeadObjectOutput{}, nil)
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload, WithBatchUploadOptions(WithNoOverwrite()), WithBatchUploadAttempts(1))
+	g.Expect(b.Add("1", []byte("payload"))).To(Succeed())
+	g.Expect(b.Close(context.Background())).To(Succeed())
+
+	g.Expect(results.get()).To(HaveLen(1))
+	g.Expect(results.get()[0].Err).To(MatchError(ErrAlreadyExists))
+}
+
+func TestBatcher_ConcurrentAdd(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil).AnyTimes()
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload, WithMaxCount(10), WithBatchUploadConcurrency(2),
+		WithBatchTempFileOptions(WithCompression(CodecZstd)))
+
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Go(func() {
+			g.Expect(b.Add(fmt.Sprint(i), []byte("payload"))).To(Succeed())
+		})
+	}
+	wg.Wait()
+	g.Expect(b.Close(context.Background())).To(Succeed())
+
+	// Every object was uploaded exactly once, and the files respect the max count
+	ids := map[string]int{}
+	for _, result := range results.get() {
+		g.Expect(result.Err).ToNot(HaveOccurred())
+		g.Expect(len(result.Indexes)).To(BeNumerically("<=", 10))
+		for id := range result.Indexes {
+			ids[id]++
+		}
+	}
+	g.Expect(ids).To(HaveLen(100))
+	for id, count := range ids {
+		g.Expect(count).To(Equal(1), id)
+	}
+}
+
+func TestBatcher_Versions(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	c := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+	s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil)
+
+	var results batchResults
+	b := NewBatcher[string](c, results.onUpload, WithBatchTempFileOptions(WithDuplicatePolicy(DuplicateKeepAll)))
+	g.Expect(b.Add("1", []byte("first"))).To(Succeed())
+	g.Expect(b.Add("1", []byte("second"))).To(Succeed())
+	g.Expect(b.Close(context.Background())).To(Succeed())
+
+	g.Expect(results.get()).To(HaveLen(1))
+	result := results.get()[0]
+	g.Expect(result.Indexes["1"].Offset).To(Equal(uint64(5)))
+	g.Expect(result.Versions).To(HaveKeyWithValue("1", HaveExactElements(HaveField("Offset", uint64(0)))))
+}
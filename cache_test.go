@@ -0,0 +1,46 @@
+package s3batchstore
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestLRUCache(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cache := newLRUCache[string, int](2)
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	g.Expect(cache.Len()).To(Equal(2))
+
+	// Reading "a" makes "b" the least recently used entry
+	v, ok := cache.Get("a")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(v).To(Equal(1))
+
+	cache.Add("c", 3)
+	g.Expect(cache.Len()).To(Equal(2))
+	_, ok = cache.Get("b")
+	g.Expect(ok).To(BeFalse())
+	v, ok = cache.Get("c")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(v).To(Equal(3))
+
+	// Overwriting an entry doesn't grow the cache
+	cache.Add("a", 10)
+	g.Expect(cache.Len()).To(Equal(2))
+	v, ok = cache.Get("a")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(v).To(Equal(10))
+}
+
+func TestLRUCache_Nil(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	var cache *lruCache[string, int]
+	cache.Add("a", 1)
+	_, ok := cache.Get("a")
+	g.Expect(ok).To(BeFalse())
+	g.Expect(cache.Len()).To(Equal(0))
+}
@@ -0,0 +1,136 @@
+package s3batchstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"maps"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// The whole file checksum is stored in the s3 user-defined metadata of the data and the meta files with these keys
+const (
+	checksumAlgorithmMetadataKey = "s3batch-checksum-algorithm"
+	checksumMetadataKey          = "s3batch-checksum"
+	// dataChecksumMetadataKey stores the checksum of the data file in the metadata of its meta file
+	dataChecksumMetadataKey = "s3batch-data-checksum"
+)
+
+// crc64NVMETable is used to compute the CRC64NVME checksums of the files
+var crc64NVMETable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+// WithChecksumAlgorithm makes UploadFile compute a checksum of the whole data file with the given algorithm, which
+// can be types.ChecksumAlgorithmCrc32c, types.ChecksumAlgorithmCrc64nvme or types.ChecksumAlgorithmSha256.
+// The checksum is sent to s3, which rejects the upload if the bytes it received don't match, and stored in the
+// user-defined metadata of the data file, so that VerifyFile can check the file integrity later.
+// The meta file is uploaded with its own checksum of the same algorithm, stored the same way so that VerifyFile
+// also accepts its key, along with the checksum of the data file.
+// Computing the checksum requires reading the whole file once before uploading it.
+func WithChecksumAlgorithm(algorithm types.ChecksumAlgorithm) UploadOption {
+	return func(o *uploadOptions) {
+		o.checksumAlgorithm = algorithm
+	}
+}
+
+// newChecksumHash returns the hash used to compute checksums with the given algorithm.
+func newChecksumHash(algorithm types.ChecksumAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32c:
+		return crc32.New(crc32cTable), nil
+	case types.ChecksumAlgorithmCrc64nvme:
+		return crc64.New(crc64NVMETable), nil
+	case types.ChecksumAlgorithmSha256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+// computeChecksum returns the base64 encoded checksum of the contents of r, as expected by s3.
+func computeChecksum(algorithm types.ChecksumAlgorithm, r io.Reader) (string, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// setPutChecksum sets the checksum of the object in the s3 request.
+func setPutChecksum(input *s3.PutObjectInput, algorithm types.ChecksumAlgorithm, checksum string) {
+	input.ChecksumAlgorithm = algorithm
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32c:
+		input.ChecksumCRC32C = aws.String(checksum)
+	case types.ChecksumAlgorithmCrc64nvme:
+		input.ChecksumCRC64NVME = aws.String(checksum)
+	case types.ChecksumAlgorithmSha256:
+		input.ChecksumSHA256 = aws.String(checksum)
+	}
+}
+
+// multipartChecksumType returns the type of checksum used by a multipart upload with the given algorithm.
+// The CRC algorithms can checksum the full object, but SHA256 can only checksum each part.
+func multipartChecksumType(algorithm types.ChecksumAlgorithm) types.ChecksumType {
+	switch algorithm {
+	case "":
+		return ""
+	case types.ChecksumAlgorithmSha256:
+		return types.ChecksumTypeComposite
+	default:
+		return types.ChecksumTypeFullObject
+	}
+}
+
+// withChecksumMetadata returns a copy of the metadata that includes the whole file checksum.
+func withChecksumMetadata(metadata map[string]string, algorithm types.ChecksumAlgorithm, checksum string) map[string]string {
+	result := make(map[string]string, len(metadata)+2)
+	maps.Copy(result, metadata)
+	result[checksumAlgorithmMetadataKey] = string(algorithm)
+	result[checksumMetadataKey] = checksum
+	return result
+}
+
+func (c *client[K]) VerifyFile(ctx context.Context, fileKey string) error {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(c.s3Bucket),
+		Key:          aws.String(fileKey),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}
+	c.sseCustomerKey.applyToGet(input)
+	result, err := c.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to download file %s/%s: %w", c.s3Bucket, fileKey, err)
+	}
+	defer func() { _ = result.Body.Close() }()
+
+	algorithm := types.ChecksumAlgorithm(result.Metadata[checksumAlgorithmMetadataKey])
+	expected, ok := result.Metadata[checksumMetadataKey]
+	if algorithm == "" || !ok {
+		return fmt.Errorf("%w: file %s/%s", ErrNoChecksum, c.s3Bucket, fileKey)
+	}
+
+	actual, err := computeChecksum(algorithm, result.Body)
+	if err != nil {
+		return fmt.Errorf("failed to compute checksum of file %s/%s: %w", c.s3Bucket, fileKey, err)
+	}
+	if actual != expected {
+		return &ChecksumMismatchError{
+			File:      fileKey,
+			Algorithm: algorithm,
+			Expected:  expected,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestComputeChecksum(t *testing.T) {
+	tests := []struct {
+		algorithm types.ChecksumAlgorithm
+		expected  string
+	}{
+		{algorithm: types.ChecksumAlgorithmCrc32c, expected: "4waSgw=="},                                     // 0xe3069283
+		{algorithm: types.ChecksumAlgorithmCrc64nvme, expected: "rosUhgp5mIg="},                              // 0xae8b14860a799888
+		{algorithm: types.ChecksumAlgorithmSha256, expected: "FeKw08M4keuw8e9gnsQZQgwg4yDOlMZfvIwzEkSOsiU="}, // sha256("123456789")
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.algorithm), func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			checksum, err := computeChecksum(tt.algorithm, strings.NewReader("123456789"))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(checksum).To(Equal(tt.expected))
+		})
+	}
+
+	_, err := computeChecksum(types.ChecksumAlgorithmMd5, strings.NewReader("123456789"))
+	NewGomegaWithT(t).Expect(err).To(MatchError(`unsupported checksum algorithm "MD5"`))
+}
+
+func TestClient_UploadFileWithChecksum(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("1234"))).To(Succeed())
+	g.Expect(file.Append("2", []byte("56789"))).To(Succeed())
+
+	metadata := map[string]string{"source": "test"}
+	expectedMetadata := map[string]string{
+		"source":                     "test",
+		"s3batch-checksum-algorithm": "CRC32C",
+		"s3batch-checksum":           "4waSgw==",
+	}
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.fileName)).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		g.Expect(input.ChecksumAlgorithm).To(Equal(types.ChecksumAlgorithmCrc32c))
+		g.Expect(input.ChecksumCRC32C).To(Equal(aws.String("4waSgw==")))
+		g.Expect(input.Metadata).To(Equal(expectedMetadata))
+		// The checksum is computed without moving the file position
+		body, err := io.ReadAll(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(string(body)).To(Equal("123456789"))
+		return &s3.PutObjectOutput{}, nil
+	})
+	var metaFile *s3.GetObjectOutput
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.MetaFileKey())).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		checksum, err := computeChecksum(types.ChecksumAlgorithmCrc32c, bytes.NewReader(body))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(input.ChecksumAlgorithm).To(Equal(types.ChecksumAlgorithmCrc32c))
+		g.Expect(input.ChecksumCRC32C).To(Equal(aws.String(checksum)))
+		// The meta file records its own checksum, and the one of the data file
+		g.Expect(input.Metadata).To(Equal(map[string]string{
+			"source":                     "test",
+			"s3batch-checksum-algorithm": "CRC32C",
+			"s3batch-checksum":           checksum,
+			"s3batch-data-checksum":      "4waSgw==",
+		}))
+		metaFile = &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body)), Metadata: input.Metadata}
+		return &s3.PutObjectOutput{}, nil
+	})
+
+	err = c.UploadFile(ctx, file, true, WithMetadata(metadata), WithChecksumAlgorithm(types.ChecksumAlgorithmCrc32c))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(metadata).To(Equal(map[string]string{"source": "test"}))
+
+	// The meta file can be verified too
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).Return(metaFile, nil)
+	g.Expect(c.VerifyFile(ctx, file.MetaFileKey())).To(Succeed())
+
+	err = c.UploadFile(ctx, file, true, WithChecksumAlgorithm(types.ChecksumAlgorithmMd5))
+	g.Expect(err).To(MatchError(`failed to compute the checksum of the data file: unsupported checksum algorithm "MD5"`))
+}
+
+func TestClient_UploadFileMultipartWithChecksum(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), int(minPartSize+1024)/16)
+	fullChecksum, err := computeChecksum(types.ChecksumAlgorithmCrc64nvme, bytes.NewReader(payload))
+	NewGomegaWithT(t).Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		algorithm    types.ChecksumAlgorithm
+		checksumType types.ChecksumType
+		completeType types.ChecksumType // Only full object checksums are sent when completing the upload
+		fullChecksum *string
+	}{
+		{
+			algorithm:    types.ChecksumAlgorithmCrc64nvme,
+			checksumType: types.ChecksumTypeFullObject,
+			completeType: types.ChecksumTypeFullObject,
+			fullChecksum: aws.String(fullChecksum),
+		},
+		{
+			algorithm:    types.ChecksumAlgorithmSha256,
+			checksumType: types.ChecksumTypeComposite,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.algorithm), func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			file, err := c.NewTempFile(testTags)
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+			g.Expect(file.Append("1", payload)).To(Succeed())
+
+			s3Mock.EXPECT().CreateMultipartUpload(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+				g.Expect(input.ChecksumAlgorithm).To(Equal(tt.algorithm))
+				g.Expect(input.ChecksumType).To(Equal(tt.checksumType))
+				g.Expect(input.Metadata).To(HaveKey(checksumMetadataKey))
+				return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil
+			})
+			var mu sync.Mutex
+			var partChecksums []string
+			s3Mock.EXPECT().UploadPart(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+				g.Expect(input.ChecksumAlgorithm).To(Equal(tt.algorithm))
+				mu.Lock()
+				defer mu.Unlock()
+				checksum := "checksum-" + strconv.Itoa(int(*input.PartNumber))
+				partChecksums = append(partChecksums, checksum)
+				return &s3.UploadPartOutput{ETag: aws.String("etag"), ChecksumCRC64NVME: aws.String(checksum), ChecksumSHA256: aws.String(checksum)}, nil
+			}).Times(2)
+			s3Mock.EXPECT().CompleteMultipartUpload(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+				g.Expect(input.ChecksumType).To(Equal(tt.completeType))
+				g.Expect(input.ChecksumCRC64NVME).To(Equal(tt.fullChecksum))
+				for i, part := range input.MultipartUpload.Parts {
+					g.Expect(part.ChecksumSHA256).To(Equal(aws.String("checksum-" + strconv.Itoa(i+1))))
+				}
+				return &s3.CompleteMultipartUploadOutput{}, nil
+			})
+
+			err = c.UploadFile(ctx, file, false, WithMultipartThreshold(minPartSize), WithPartSize(minPartSize), WithChecksumAlgorithm(tt.algorithm))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(partChecksums).To(HaveLen(2))
+		})
+	}
+}
+
+func TestClient_VerifyFile(t *testing.T) {
+	const fileKey = "file"
+	contents := []byte("123456789")
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		err      error
+		expected any
+	}{
+		{
+			name:     "valid checksum",
+			metadata: map[string]string{checksumAlgorithmMetadataKey: "CRC32C", checksumMetadataKey: "4waSgw=="},
+		},
+		{
+			name:     "checksum mismatch",
+			metadata: map[string]string{checksumAlgorithmMetadataKey: "CRC32C", checksumMetadataKey: "AAAAAA=="},
+			expected: &ChecksumMismatchError{
+				File:      fileKey,
+				Algorithm: types.ChecksumAlgorithmCrc32c,
+				Expected:  "AAAAAA==",
+				Actual:    "4waSgw==",
+			},
+		},
+		{
+			name:     "no checksum",
+			metadata: map[string]string{"source": "test"},
+			expected: ErrNoChecksum,
+		},
+		{
+			name:     "unsupported algorithm",
+			metadata: map[string]string{checksumAlgorithmMetadataKey: "MD5", checksumMetadataKey: "AAAAAA=="},
+			expected: `failed to compute checksum of file test-bucket/file: unsupported checksum algorithm "MD5"`,
+		},
+		{
+			name:     "download error",
+			err:      errors.New("error connecting to s3"),
+			expected: "failed to download file test-bucket/file: error connecting to s3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				g.Expect(*input.Key).To(Equal(fileKey))
+				g.Expect(input.Range).To(BeNil())
+				g.Expect(input.ChecksumMode).To(Equal(types.ChecksumModeEnabled))
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(contents)), Metadata: tt.metadata}, nil
+			})
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+			err := c.VerifyFile(ctx, fileKey)
+			if tt.expected == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				g.Expect(err).To(MatchError(tt.expected))
+			}
+		})
+	}
+}
+
+func TestChecksumMismatchError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	err := &ChecksumMismatchError{File: "file", Algorithm: types.ChecksumAlgorithmSha256, Expected: "a", Actual: "b"}
+	g.Expect(err).To(MatchError("file file is corrupted: expected SHA256 checksum a, got b"))
+}
@@ -2,6 +2,11 @@ package s3batchstore
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -17,15 +22,63 @@ import (
 type Client[K comparable] interface {
 	// NewTempFile creates a new file in a temp folder.
 	// tags can be used to store information about this file in S3, like retention days
-	// The file itself is not thread safe, if you expect to make concurrent calls to Append, you should protect it.
+	// The file is safe for concurrent use, so many goroutines can Append to it at the same time.
 	// Once all the objects are appended, you can call UploadFile to upload the file to s3.
-	NewTempFile(tags map[string]string) (*TempFile[K], error)
+	// opts are applied after the ones configured in the client with WithTempFileOptions.
+	NewTempFile(tags map[string]string, opts ...TempFileOption) (*TempFile[K], error)
 
 	// UploadFile will take a TempFile that already has all the objects in it, and upload it to a s3 file,
-	// in one single operation.
+	// in one single operation. Files larger than the multipart threshold (see WithMultipartThreshold) are uploaded
+	// in parts instead, which are uploaded concurrently, and aborted if the upload fails.
 	// withMetaFile indicates whether the metadata will be also uploaded to the file.MetaFileKey() location,
 	// with the index information for each object, or not.
-	UploadFile(ctx context.Context, file *TempFile[K], withMetaFile bool) error
+	// opts are applied after the ones configured in the client with WithUploadOptions, and apply to both the data
+	// file and the meta file, unless stated otherwise.
+	// With WithNoOverwrite, existing files are never replaced, which makes it safe to retry failed uploads.
+	UploadFile(ctx context.Context, file *TempFile[K], withMetaFile bool, opts ...UploadOption) error
+
+	// LoadIndexes downloads the meta file that was uploaded along with the file identified by fileKey
+	// (when calling UploadFile with withMetaFile=true), and returns the indexes of all the objects in that file.
+	// This allows to rebuild the index information of a file without having to store it elsewhere.
+	// If the meta file doesn't exist, the indexes are read from the footer of files uploaded with WithFooterIndex.
+	LoadIndexes(ctx context.Context, fileKey string) (map[K]ObjectIndex, error)
+
+	// LoadMetaFile downloads the meta file of the file identified by fileKey, like LoadIndexes, and also returns
+	// its header, which describes the data file. Meta files in any of the supported versions can be read.
+	LoadMetaFile(ctx context.Context, fileKey string) (*MetaFile[K], error)
+
+	// ReadFooter reads the index of the file identified by fileKey from its footer, for files uploaded with
+	// WithFooterIndex. It downloads the end of the file with a suffix range request, and a second range request
+	// only if the footer is larger than the downloaded bytes. It returns an error wrapping ErrNoFooter if the file
+	// has no footer index.
+	ReadFooter(ctx context.Context, fileKey string) (*MetaFile[K], error)
+
+	// FetchByID downloads the payload of the object identified by id from the file identified by fileKey.
+	// The object index is resolved using the meta file of that file, or its footer index if it has no meta file,
+	// so this only works for files uploaded with withMetaFile=true or WithFooterIndex. The decoded meta files are
+	// kept in a LRU cache (see WithIndexCacheSize), so fetching many objects from the same file only downloads its
+	// meta file once.
+	// If the id is not present in the file, an error wrapping ErrObjectNotFound is returned.
+	FetchByID(ctx context.Context, fileKey string, id K) ([]byte, error)
+
+	// FetchWithMetadata is the same as FetchByID, but it also returns the attributes that were provided when
+	// appending the object (see AppendOption). Objects appended without attributes return empty ObjectAttributes.
+	// The returned attributes are shared with the index cache, so their Metadata must not be modified.
+	FetchWithMetadata(ctx context.Context, fileKey string, id K) ([]byte, ObjectAttributes, error)
+
+	// Scan reads all the objects of the file identified by fileKey, calling fn for each of them in the order they
+	// are stored in the file. The file is downloaded once, streaming its contents, and the objects are resolved
+	// using its meta file, or its footer index if it has no meta file, so this only works for files uploaded with
+	// withMetaFile=true or WithFooterIndex.
+	// If fn returns an error, the scan stops and that error is returned.
+	Scan(ctx context.Context, fileKey string, fn func(id K, payload []byte) error) error
+
+	// VerifyFile downloads the whole file identified by fileKey, a data file or a meta file, and compares its checksum
+	// with the one computed when it was uploaded with WithChecksumAlgorithm, returning a *ChecksumMismatchError if
+	// they don't match.
+	// s3 also validates the checksum it stored for the file while it is downloaded, when possible.
+	// If the file was uploaded without a checksum, an error wrapping ErrNoChecksum is returned.
+	VerifyFile(ctx context.Context, fileKey string) error
 
 	// DeleteFile allows to try to delete any files that may have been uploaded to s3 based on the provided file.
 	// This is provided in case of any error when calling UploadFile, callers have the possibility to clean up the files.
@@ -34,7 +87,22 @@ type Client[K comparable] interface {
 	// Fetch downloads the payload from s3 given the ObjectIndex, fetching only the needed bytes, and returning
 	// the payload as a byte array.
 	// The caller is responsible for decompressing/unmarshalling or any operation needed to parse it to the proper struct.
+	// If the index has a checksum (see WithChecksums), the payload is verified, returning a *CorruptionError
+	// if it doesn't match. If the object was compressed or encrypted by the TempFile (see WithCompression and
+	// WithEncryption), it is decrypted and decompressed.
 	Fetch(ctx context.Context, ind ObjectIndex) ([]byte, error)
+
+	// FetchReader is the same as Fetch, but instead of reading the whole payload into memory, it returns a reader
+	// that streams the bytes from s3 as they are read.
+	// The caller is responsible for closing the returned reader.
+	// If the index has a checksum, it is verified once the reader is fully read, returning a *CorruptionError
+	// instead of io.EOF if it doesn't match.
+	FetchReader(ctx context.Context, ind ObjectIndex) (io.ReadCloser, error)
+
+	// FetchMany downloads the payloads for all the given indexes, returning them in the same order as requested.
+	// Indexes that point to the same file and are contiguous (or within the gap configured with WithFetchMaxGap)
+	// are coalesced into a single ranged GET, so fetching many objects from the same batch costs a single request.
+	FetchMany(ctx context.Context, inds []ObjectIndex) ([][]byte, error)
 }
 
 // S3Client is used to mock the aws s3 functions used in this module.
@@ -44,19 +112,171 @@ type S3Client interface {
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 }
 
 type client[K comparable] struct {
-	s3Client S3Client
-	s3Bucket string
+	clientOptions
+	s3Client   S3Client
+	s3Bucket   string
+	indexCache *lruCache[string, map[K]ObjectIndex] // Decoded meta files by file key, nil when disabled
+	idCodec    KeyCodec[K]                          // Used to store the object ids in the meta files
+
+	dataKeyCache *lruCache[string, cipher.AEAD] // Unwrapped data keys by wrapped key, nil when disabled
+}
+
+// ClientOption allows to customize the behaviour of the Client created with NewClient.
+type ClientOption func(*clientOptions)
+
+// clientOptions holds the optional settings of a client. The zero value is a valid configuration.
+type clientOptions struct {
+	fetchMaxGap    uint64 // Max number of unrequested bytes between two objects for FetchMany to merge their ranges
+	indexCacheSize int    // Max number of meta files kept in memory by FetchByID
+	tempFileOpts   []TempFileOption
+	keyProvider    KeyProvider // Used to unwrap the data keys of encrypted objects
+	uploadOpts     []UploadOption
+	sseCustomerKey *sseCustomerKey // Used to upload and download all the files, if set
+	keyCodec       any             // The KeyCodec of the object ids, nil to use the default one
+}
+
+// defaultIndexCacheSize is the default number of decoded meta files kept in memory by FetchByID
+const defaultIndexCacheSize = 100
+
+// dataKeyCacheSize is the number of unwrapped data keys kept in memory to decrypt objects
+const dataKeyCacheSize = 1000
+
+// WithFetchMaxGap sets the maximum number of bytes that may separate two objects of the same file for FetchMany
+// to download them in a single GET. The bytes in the gap are downloaded and discarded, so this trades
+// transferred bytes for fewer requests. By default only contiguous objects are merged.
+func WithFetchMaxGap(gap uint64) ClientOption {
+	return func(o *clientOptions) {
+		o.fetchMaxGap = gap
+	}
+}
+
+// WithIndexCacheSize sets the maximum number of decoded meta files that FetchByID keeps in memory.
+// A size of zero or less disables the cache. Defaults to 100.
+func WithIndexCacheSize(size int) ClientOption {
+	return func(o *clientOptions) {
+		o.indexCacheSize = size
+	}
+}
+
+// WithTempFileOptions sets the default options used for every file created with the client NewTempFile method.
+func WithTempFileOptions(opts ...TempFileOption) ClientOption {
+	return func(o *clientOptions) {
+		o.tempFileOpts = append(o.tempFileOpts, opts...)
+	}
+}
+
+// WithKeyProvider sets the KeyProvider used to unwrap the data keys of encrypted objects when fetching them.
+// It doesn't encrypt the files created with the client NewTempFile method, to do so, also set
+// WithTempFileOptions(WithEncryption(keyProvider)).
+func WithKeyProvider(keyProvider KeyProvider) ClientOption {
+	return func(o *clientOptions) {
+		o.keyProvider = keyProvider
+	}
 }
 
+// WithUploadOptions sets the default options used for every call to UploadFile.
+func WithUploadOptions(opts ...UploadOption) ClientOption {
+	return func(o *clientOptions) {
+		o.uploadOpts = append(o.uploadOpts, opts...)
+	}
+}
+
+// WithSSECustomerKey makes s3 encrypt the files with the given 256 bits customer provided key (SSE-C).
+// The key is sent with every request to upload or download a file, as s3 doesn't store it, so the files can
+// only be fetched by clients configured with the same key. It can't be combined with WithSSES3 or WithSSEKMS.
+// It panics if the key is not 32 bytes long.
+func WithSSECustomerKey(key []byte) ClientOption {
+	if len(key) != sseCustomerKeySize {
+		panic(fmt.Sprintf("s3batchstore: the SSE-C key must be %d bytes long, got %d", sseCustomerKeySize, len(key)))
+	}
+	return func(o *clientOptions) {
+		o.sseCustomerKey = newSSECustomerKey(key)
+	}
+}
+
+// sseCustomerKey holds the parameters for s3 server side encryption with a customer provided key (SSE-C).
+// A nil *sseCustomerKey means that SSE-C is not used.
+type sseCustomerKey struct {
+	key    string // base64 encoded key
+	keyMD5 string // base64 encoded MD5 digest of the key
+}
+
+func newSSECustomerKey(key []byte) *sseCustomerKey {
+	digest := md5.Sum(key)
+	return &sseCustomerKey{
+		key:    base64.StdEncoding.EncodeToString(key),
+		keyMD5: base64.StdEncoding.EncodeToString(digest[:]),
+	}
+}
+
+func (k *sseCustomerKey) applyToPut(input *s3.PutObjectInput) {
+	if k == nil {
+		return
+	}
+	input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+	input.SSECustomerKey = aws.String(k.key)
+	input.SSECustomerKeyMD5 = aws.String(k.keyMD5)
+}
+
+func (k *sseCustomerKey) applyToGet(input *s3.GetObjectInput) {
+	if k == nil {
+		return
+	}
+	input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+	input.SSECustomerKey = aws.String(k.key)
+	input.SSECustomerKeyMD5 = aws.String(k.keyMD5)
+}
+
+func (k *sseCustomerKey) applyToHead(input *s3.HeadObjectInput) {
+	if k == nil {
+		return
+	}
+	input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+	input.SSECustomerKey = aws.String(k.key)
+	input.SSECustomerKeyMD5 = aws.String(k.keyMD5)
+}
+
+// sseCustomerAlgorithm is the only algorithm supported by s3 for SSE-C
+const sseCustomerAlgorithm = "AES256"
+
+// sseCustomerKeySize is the size in bytes of the keys used by sseCustomerAlgorithm
+const sseCustomerKeySize = 32
+
 // NewClient creates a new client that can be used to upload and download objects to s3.
 // K represents the type of IDs for the objects that will be uploaded and fetched.
-func NewClient[K comparable](awsConfig aws.Config, s3Bucket string) Client[K] {
+// It panics if the IDs of type K can't be stored in the meta files, because no KeyCodec is set with WithKeyCodec and
+// they have no default one, or because that codec is for IDs of another type.
+func NewClient[K comparable](awsConfig aws.Config, s3Bucket string, opts ...ClientOption) Client[K] {
 	s3Client := s3.NewFromConfig(awsConfig)
-	return &client[K]{
+	c := &client[K]{
+		clientOptions: clientOptions{
+			indexCacheSize: defaultIndexCacheSize,
+		},
 		s3Client: s3Client,
 		s3Bucket: s3Bucket,
 	}
+	for _, opt := range opts {
+		opt(&c.clientOptions)
+	}
+	// Fail now instead of when uploading the first file
+	idCodec, err := resolveKeyCodec[K](c.clientOptions.keyCodec)
+	if err != nil {
+		panic(fmt.Sprintf("s3batchstore: %v", err))
+	}
+	c.idCodec = idCodec
+	if c.indexCacheSize > 0 {
+		c.indexCache = newLRUCache[string, map[K]ObjectIndex](c.indexCacheSize)
+	}
+	if c.keyProvider != nil {
+		c.dataKeyCache = newLRUCache[string, cipher.AEAD](dataKeyCacheSize)
+	}
+	return c
 }
@@ -14,4 +14,16 @@ func TestNewClient(t *testing.T) {
 	g.Expect(c).ToNot(BeNil())
 	g.Expect(c.(*client[string]).s3Client).ToNot(BeNil())
 	g.Expect(c.(*client[string]).s3Bucket).To(Equal(testBucketName))
+	g.Expect(c.(*client[string]).indexCache).ToNot(BeNil())
+}
+
+func TestNewClient_WithOptions(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	c := NewClient[string](aws.Config{}, testBucketName,
+		WithFetchMaxGap(1024),
+		WithIndexCacheSize(0),
+	)
+	g.Expect(c.(*client[string]).fetchMaxGap).To(Equal(uint64(1024)))
+	g.Expect(c.(*client[string]).indexCache).To(BeNil())
 }
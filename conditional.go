@@ -0,0 +1,104 @@
+package s3batchstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// WithNoOverwrite makes UploadFile use a conditional write (If-None-Match: *), so that s3 never replaces a file
+// that already exists. If the file exists with the same checksum, for example because a previous attempt succeeded
+// but timed out, the upload is considered successful. Otherwise, an error wrapping ErrAlreadyExists is returned.
+// The same applies when the write conflicts with a concurrent upload of the file, like a retry racing a request
+// that is still in flight, once that upload completes.
+// This applies to both the data file and the meta file. The checksums are computed as with WithChecksumAlgorithm,
+// which defaults to CRC32C when using this option.
+func WithNoOverwrite() UploadOption {
+	return func(o *uploadOptions) {
+		o.noOverwrite = true
+	}
+}
+
+// applyConditionalWrite makes the s3 request fail if the object already exists, when using WithNoOverwrite.
+func (o *uploadOptions) applyConditionalWrite(input *s3.PutObjectInput) {
+	if o.noOverwrite {
+		input.IfNoneMatch = aws.String("*")
+	}
+}
+
+const (
+	// conditionalRequestConflict is the error code of a conditional write that conflicts with a concurrent write of
+	// the same object (409), for example when a retry races a request that is still in flight
+	conditionalRequestConflict = "ConditionalRequestConflict"
+	// conflictCheckAttempts is the number of times the existing object is checked after a conflicting conditional
+	// write, as the concurrent write may not have completed yet
+	conflictCheckAttempts = 4
+	// conflictCheckBackoff is the wait before checking the existing object again, it doubles after each attempt
+	conflictCheckBackoff = 200 * time.Millisecond
+)
+
+// isPreconditionFailed returns whether the error was caused by a conditional write on an existing object, or on
+// an object that is being written concurrently.
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == conditionalRequestConflict)
+}
+
+// isConditionalRequestConflict returns whether a conditional write failed because of a concurrent write.
+func isConditionalRequestConflict(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == conditionalRequestConflict
+}
+
+// checkExistingObject is used when a conditional write fails with writeErr because the object already exists, it
+// returns nil if the existing object is the one being uploaded according to matches, or an error wrapping
+// ErrAlreadyExists otherwise. If the write conflicted with a concurrent one, the object is checked again until that
+// write completes, and writeErr is returned if it never does.
+func (c *client[K]) checkExistingObject(ctx context.Context, key string, writeErr error, matches func(*s3.HeadObjectOutput) bool) error {
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(c.s3Bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}
+	c.sseCustomerKey.applyToHead(input)
+	head, err := c.s3Client.HeadObject(ctx, input)
+	if isConditionalRequestConflict(writeErr) {
+		backoff := conflictCheckBackoff
+		for attempt := 1; attempt < conflictCheckAttempts && isMissingObject(err); attempt++ {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return errors.Join(writeErr, ctx.Err())
+			}
+			head, err = c.s3Client.HeadObject(ctx, input)
+		}
+		if isMissingObject(err) {
+			// The concurrent write didn't complete, so the object doesn't exist
+			return writeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s/%s, and failed to check its checksum: %w", ErrAlreadyExists, c.s3Bucket, key, err)
+	}
+	if !matches(head) {
+		return fmt.Errorf("%w: %s/%s, with a different checksum", ErrAlreadyExists, c.s3Bucket, key)
+	}
+	return nil
+}
+
+// metadataChecksumMatches returns a function that checks whether an object has the given whole file checksum in
+// its metadata, as stored by UploadFile for both the data files and the meta files.
+func metadataChecksumMatches(algorithm types.ChecksumAlgorithm, checksum string) func(*s3.HeadObjectOutput) bool {
+	return func(head *s3.HeadObjectOutput) bool {
+		return head.Metadata[checksumAlgorithmMetadataKey] == string(algorithm) &&
+			head.Metadata[checksumMetadataKey] == checksum
+	}
+}
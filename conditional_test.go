@@ -0,0 +1,210 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestClient_UploadFileNoOverwrite(t *testing.T) {
+	preconditionFailed := &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	conflict := &smithy.GenericAPIError{Code: "ConditionalRequestConflict", Message: "A conflicting conditional operation is currently in progress against this resource"}
+	notFound := &smithy.GenericAPIError{Code: "NotFound", Message: "Not Found"}
+	const dataChecksum = "4waSgw==" // CRC32C of the file contents
+
+	tests := []struct {
+		name           string
+		configureMocks func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client)
+		err            any
+	}{
+		{
+			name: "new file",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					g.Expect(input.IfNoneMatch).To(Equal(aws.String("*")))
+					// The checksum defaults to CRC32C, to be able to compare with existing files
+					g.Expect(input.ChecksumAlgorithm).To(Equal(types.ChecksumAlgorithmCrc32c))
+					return &s3.PutObjectOutput{}, nil
+				}).Times(2)
+			},
+		},
+		{
+			name: "same file already uploaded",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				var metafileMetadata map[string]string
+				s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					if *input.Key == file.MetaFileKey() {
+						metafileMetadata = input.Metadata
+					}
+					return nil, preconditionFailed
+				}).Times(2)
+				s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					g.Expect(*input.Bucket).To(Equal(testBucketName))
+					g.Expect(input.ChecksumMode).To(Equal(types.ChecksumModeEnabled))
+					if *input.Key == file.MetaFileKey() {
+						return &s3.HeadObjectOutput{Metadata: metafileMetadata}, nil
+					}
+					g.Expect(*input.Key).To(Equal(file.fileName))
+					return &s3.HeadObjectOutput{
+						ChecksumCRC32C: aws.String("not a full object checksum-2"),
+						Metadata: map[string]string{
+							checksumAlgorithmMetadataKey: "CRC32C",
+							checksumMetadataKey:          dataChecksum,
+						},
+					}, nil
+				}).Times(2)
+			},
+		},
+		{
+			name: "different file already uploaded",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(nil, preconditionFailed)
+				s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(&s3.HeadObjectOutput{
+					Metadata: map[string]string{
+						checksumAlgorithmMetadataKey: "CRC32C",
+						checksumMetadataKey:          "AAAAAA==",
+					},
+				}, nil)
+			},
+			err: ErrAlreadyExists,
+		},
+		{
+			name: "meta file with a different checksum",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(file.fileName)).Return(&s3.PutObjectOutput{}, nil)
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(file.MetaFileKey())).Return(nil, preconditionFailed)
+				s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(&s3.HeadObjectOutput{
+					Metadata: map[string]string{
+						checksumAlgorithmMetadataKey: "CRC32C",
+						checksumMetadataKey:          "AAAAAA==",
+					},
+				}, nil)
+			},
+			err: "failed to upload meta file to s3: file already exists: test-bucket/FILE.meta.json.zst, with a different checksum",
+		},
+		{
+			name: "write conflicting with one in flight",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(file.fileName)).Return(nil, conflict)
+				// The existing file is checked again until the concurrent write completes
+				gomock.InOrder(
+					s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(nil, notFound),
+					s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(&s3.HeadObjectOutput{
+						Metadata: map[string]string{
+							checksumAlgorithmMetadataKey: "CRC32C",
+							checksumMetadataKey:          dataChecksum,
+						},
+					}, nil),
+				)
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(file.MetaFileKey())).Return(&s3.PutObjectOutput{}, nil)
+			},
+		},
+		{
+			name: "write conflicting with one that never completes",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(nil, conflict)
+				s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(nil, notFound).Times(conflictCheckAttempts)
+			},
+			err: "failed to upload data file to s3: api error ConditionalRequestConflict: A conflicting conditional operation is currently in progress against this resource",
+		},
+		{
+			name: "existing file can't be checked",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(nil, preconditionFailed)
+				s3Mock.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(nil, errors.New("access denied"))
+			},
+			err: "failed to upload data file to s3: file already exists: test-bucket/FILE, and failed to check its checksum: access denied",
+		},
+		{
+			name: "other errors",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), gomock.Any()).Return(nil, &smithy.GenericAPIError{Code: "InternalError"})
+			},
+			err: "failed to upload data file to s3: api error InternalError: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+			file, err := c.NewTempFile(testTags, WithKeyStrategy(KeyStrategyFunc(func(FileKeyInput) string { return "FILE" })))
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+			g.Expect(file.Append("1", []byte("123456789"))).To(Succeed())
+
+			tt.configureMocks(g, file, s3Mock)
+			err = c.UploadFile(ctx, file, true, WithNoOverwrite())
+			if tt.err == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				g.Expect(err).To(MatchError(tt.err))
+			}
+		})
+	}
+}
+
+func TestClient_UploadFileNoOverwriteMultipart(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	payload := bytes.Repeat([]byte("0123456789abcdef"), int(minPartSize)/16+1)
+	g.Expect(file.Append("1", payload)).To(Succeed())
+	checksum, err := computeChecksum(types.ChecksumAlgorithmSha256, bytes.NewReader(payload))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	s3Mock.EXPECT().CreateMultipartUpload(ctx, gomock.Any()).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil)
+	s3Mock.EXPECT().UploadPart(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+		_, err := io.Copy(io.Discard, input.Body)
+		return &s3.UploadPartOutput{ETag: aws.String("etag")}, err
+	}).Times(2)
+	s3Mock.EXPECT().CompleteMultipartUpload(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+		g.Expect(input.IfNoneMatch).To(Equal(aws.String("*")))
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	})
+	s3Mock.EXPECT().AbortMultipartUpload(gomock.Any(), gomock.Any()).Return(&s3.AbortMultipartUploadOutput{}, nil)
+	s3Mock.EXPECT().HeadObject(ctx, gomock.Any()).Return(&s3.HeadObjectOutput{
+		Metadata: map[string]string{
+			checksumAlgorithmMetadataKey: "SHA256",
+			checksumMetadataKey:          checksum,
+		},
+	}, nil)
+
+	err = c.UploadFile(ctx, file, false,
+		WithNoOverwrite(),
+		WithChecksumAlgorithm(types.ChecksumAlgorithmSha256),
+		WithMultipartThreshold(minPartSize),
+		WithPartSize(minPartSize),
+	)
+	g.Expect(err).ToNot(HaveOccurred())
+}
@@ -1,27 +1,137 @@
 package s3batchstore
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"slices"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 func (c *client[K]) Fetch(ctx context.Context, ind ObjectIndex) ([]byte, error) {
-	byteRange := byteRangeString(ind.Offset, ind.Length)
-	result, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+	stored, err := c.fetchRange(ctx, ind.File, ind.Offset, ind.Length)
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeObject(ctx, ind, stored)
+}
+
+func (c *client[K]) FetchReader(ctx context.Context, ind ObjectIndex) (io.ReadCloser, error) {
+	body, err := c.openRange(ctx, ind.File, ind.Offset, ind.Length)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := c.newDecodingReader(ctx, body, ind)
+	if err != nil {
+		_ = body.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (c *client[K]) FetchMany(ctx context.Context, inds []ObjectIndex) ([][]byte, error) {
+	results := make([][]byte, len(inds))
+	for _, span := range coalesceIndexes(inds, c.fetchMaxGap) {
+		body, err := c.fetchRange(ctx, span.file, span.offset, span.length)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(body)) != span.length {
+			return nil, fmt.Errorf("unexpected length for file %s/%s %s: got %d bytes",
+				c.s3Bucket, span.file, byteRangeString(span.offset, span.length), len(body))
+		}
+
+		// Slice the span back into the individual objects
+		for _, i := range span.members {
+			start := inds[i].Offset - span.offset
+			end := start + inds[i].Length
+			if results[i], err = c.decodeObject(ctx, inds[i], body[start:end:end]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// fetchRange downloads length bytes starting at offset from the given s3 file.
+func (c *client[K]) fetchRange(ctx context.Context, file string, offset, length uint64) ([]byte, error) {
+	body, err := c.openRange(ctx, file, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = body.Close() }()
+	return io.ReadAll(body)
+}
+
+// openRange starts the download of length bytes starting at offset from the given s3 file, and returns the body.
+// Empty ranges are not downloaded, as they can't be expressed as a byte range.
+func (c *client[K]) openRange(ctx context.Context, file string, offset, length uint64) (io.ReadCloser, error) {
+	if length == 0 {
+		return http.NoBody, nil
+	}
+	byteRange := byteRangeString(offset, length)
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(c.s3Bucket),
-		Key:    aws.String(ind.File),
+		Key:    aws.String(file),
 		Range:  aws.String(byteRange),
-	})
+	}
+	c.sseCustomerKey.applyToGet(input)
+	result, err := c.s3Client.GetObject(ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download object from file %s/%s %s: %w", c.s3Bucket, ind.File, byteRange, err)
+		return nil, fmt.Errorf("failed to download object from file %s/%s %s: %w", c.s3Bucket, file, byteRange, err)
 	}
+	return result.Body, nil
+}
+
+// fetchSpan is a contiguous range of bytes of a file that covers one or more of the requested objects.
+type fetchSpan struct {
+	file    string
+	offset  uint64
+	length  uint64
+	members []int // The positions in the requested indexes of the objects covered by this span
+}
 
-	defer func() { _ = result.Body.Close() }()
-	return io.ReadAll(result.Body)
+// coalesceIndexes groups the indexes by file, and merges the ranges that are contiguous, overlapping,
+// or separated by at most maxGap bytes into spans that can be downloaded with a single request.
+func coalesceIndexes(inds []ObjectIndex, maxGap uint64) []fetchSpan {
+	order := make([]int, len(inds))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Or(
+			cmp.Compare(inds[a].File, inds[b].File),
+			cmp.Compare(inds[a].Offset, inds[b].Offset),
+		)
+	})
+
+	var spans []fetchSpan
+	for _, i := range order {
+		ind := inds[i]
+		if len(spans) > 0 {
+			last := &spans[len(spans)-1]
+			end := last.offset + last.length
+			if last.file == ind.File && ind.Offset <= end+maxGap {
+				if indEnd := ind.Offset + ind.Length; indEnd > end {
+					last.length = indEnd - last.offset
+				}
+				last.members = append(last.members, i)
+				continue
+			}
+		}
+		spans = append(spans, fetchSpan{
+			file:    ind.File,
+			offset:  ind.Offset,
+			length:  ind.Length,
+			members: []int{i},
+		})
+	}
+	return spans
 }
 
 // byteRangeString generates the byte range to read a byte range from an s3 file.
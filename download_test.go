@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -65,6 +68,7 @@ func TestClient_Fetch(t *testing.T) {
 	s3Mock := mocks3.NewMockS3Client(ctrl)
 
 	c := client[string]{
+		idCodec:  StringKeyCodec[string](),
 		s3Bucket: testBucketName,
 		s3Client: s3Mock,
 	}
@@ -147,6 +151,7 @@ func TestClient_FetchError(t *testing.T) {
 	}).Times(1)
 
 	c := client[string]{
+		idCodec:  StringKeyCodec[string](),
 		s3Bucket: testBucketName,
 		s3Client: s3Mock,
 	}
@@ -156,3 +161,435 @@ func TestClient_FetchError(t *testing.T) {
 	g.Expect(err).To(MatchError("failed to download object from file test-bucket/1234 bytes=0-119: error connecting to s3"))
 	g.Expect(b).To(BeNil())
 }
+
+func TestClient_FetchChecksum(t *testing.T) {
+	contents := []byte("aaaaaaaaaabbbbbbbbbb")
+	checksumA := crc32.Checksum([]byte("aaaaaaaaaa"), crc32cTable)
+	checksumB := crc32.Checksum([]byte("bbbbbbbbbb"), crc32cTable)
+
+	tests := []struct {
+		name string
+		ind  ObjectIndex
+		err  error
+	}{
+		{
+			name: "matching checksum",
+			ind:  ObjectIndex{File: "1234", Offset: 10, Length: 10, CRC32C: &checksumB},
+		},
+		{
+			name: "wrong offset",
+			ind:  ObjectIndex{File: "1234", Offset: 0, Length: 10, CRC32C: &checksumB},
+			err: &CorruptionError{
+				Index:    ObjectIndex{File: "1234", Offset: 0, Length: 10, CRC32C: &checksumB},
+				Expected: checksumB,
+				Actual:   checksumA,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(options *s3.Options)) (*s3.GetObjectOutput, error) {
+				return getObjectFromBytes(g, contents, input)
+			}).Times(3)
+
+			c := client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			b, err := c.Fetch(ctx, test.ind)
+			if test.err == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(string(b)).To(Equal("bbbbbbbbbb"))
+			} else {
+				var corruptionErr *CorruptionError
+				g.Expect(errors.As(err, &corruptionErr)).To(BeTrue())
+				g.Expect(corruptionErr).To(Equal(test.err))
+				g.Expect(b).To(BeNil())
+			}
+
+			results, err := c.FetchMany(ctx, []ObjectIndex{test.ind})
+			if test.err == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(string(results[0])).To(Equal("bbbbbbbbbb"))
+			} else {
+				g.Expect(err).To(Equal(test.err))
+			}
+
+			reader, err := c.FetchReader(ctx, test.ind)
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = reader.Close() }()
+			b, err = io.ReadAll(reader)
+			if test.err == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(string(b)).To(Equal("bbbbbbbbbb"))
+			} else {
+				g.Expect(err).To(Equal(test.err))
+			}
+		})
+	}
+}
+
+func TestClient_FetchCompressed(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	file, err := NewTempFile[string](testTags, WithCompression(CodecZstd), WithChecksums())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	payloads := map[string][]byte{
+		"1": bytes.Repeat([]byte("my first payload "), 100),
+		"2": bytes.Repeat([]byte("my second payload "), 100),
+		"3": {},
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		index, err := file.AppendAndReturnIndex(id, payloads[id])
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(index.Codec).To(Equal(CodecZstd))
+		g.Expect(index.UncompressedLength).To(Equal(uint64(len(payloads[id]))))
+		if len(payloads[id]) > 0 {
+			g.Expect(index.Length).To(BeNumerically("<", len(payloads[id])))
+		}
+	}
+	contents := tempFileContents(g, file)
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(options *s3.Options)) (*s3.GetObjectOutput, error) {
+		return getObjectFromBytes(g, contents, input)
+	}).AnyTimes()
+
+	c := client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	for id, ind := range file.Indexes() {
+		b, err := c.Fetch(ctx, ind)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(b).To(Equal(payloads[id]))
+
+		results, err := c.FetchMany(ctx, []ObjectIndex{ind})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(results[0]).To(Equal(payloads[id]))
+
+		reader, err := c.FetchReader(ctx, ind)
+		g.Expect(err).ToNot(HaveOccurred())
+		b, err = io.ReadAll(reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(b).To(BeEquivalentTo(payloads[id]))
+		g.Expect(reader.Close()).To(Succeed())
+	}
+
+	// A corrupted uncompressed length doesn't prevent decoding the object
+	ind := file.Indexes()["1"]
+	ind.UncompressedLength = math.MaxUint64
+	b, err := c.Fetch(ctx, ind)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(b).To(Equal(payloads["1"]))
+
+	// Unknown codecs can't be decoded
+	ind.Codec = "lz4"
+	_, err = c.Fetch(ctx, ind)
+	g.Expect(err).To(MatchError(fmt.Sprintf(`unsupported codec "lz4" for object in file %s %s`, ind.File, byteRangeString(ind.Offset, ind.Length))))
+	_, err = c.FetchReader(ctx, ind)
+	g.Expect(err).To(MatchError(fmt.Sprintf(`unsupported codec "lz4" for object in file %s %s`, ind.File, byteRangeString(ind.Offset, ind.Length))))
+}
+
+func TestClient_FetchEmptyObject(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	file, err := NewTempFile[string](testTags, WithChecksums())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("first", []byte("payload"))).To(Succeed())
+	g.Expect(file.Append("empty", []byte{})).To(Succeed())
+	empty := file.Indexes()["empty"]
+	g.Expect(empty.Offset).To(Equal(uint64(len("payload"))))
+	// An empty object at the start of the file has the same index as one that would cover the whole file
+	start := empty
+	start.Offset = 0
+
+	metaBody, err := encodeMetaFile(newMetaFile(file, "", ""), MetaFileV2, StringKeyCodec[string]())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// Only the meta file is downloaded, as there are no bytes to download for empty objects
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		g.Expect(*input.Key).To(Equal(file.MetaFileKey()))
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(metaBody))}, nil
+	}).Times(2)
+
+	c := client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	for _, ind := range []ObjectIndex{empty, start} {
+		b, err := c.Fetch(ctx, ind)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(b).To(BeEmpty())
+
+		reader, err := c.FetchReader(ctx, ind)
+		g.Expect(err).ToNot(HaveOccurred())
+		b, err = io.ReadAll(reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(b).To(BeEmpty())
+		g.Expect(reader.Close()).To(Succeed())
+	}
+
+	results, err := c.FetchMany(ctx, []ObjectIndex{empty, start})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(results).To(HaveExactElements(BeEmpty(), BeEmpty()))
+
+	b, err := c.FetchByID(ctx, file.Name(), "empty")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(b).To(BeEmpty())
+
+	b, attrs, err := c.FetchWithMetadata(ctx, file.Name(), "empty")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(b).To(BeEmpty())
+	g.Expect(attrs).To(Equal(ObjectAttributes{}))
+}
+
+func TestCorruptionError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	checksum := uint32(0xe3069283)
+	err := &CorruptionError{
+		Index:    ObjectIndex{File: "1234", Offset: 10, Length: 10, CRC32C: &checksum},
+		Expected: checksum,
+		Actual:   0x1234,
+	}
+	g.Expect(err).To(MatchError("object in file 1234 bytes=10-19 is corrupted: expected crc32c e3069283, got 00001234"))
+}
+
+func TestClient_FetchReader(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctx := context.Background()
+	contents := []byte("aaaaaaaaaabbbbbbbbbbcccccccccc")
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(options *s3.Options)) (*s3.GetObjectOutput, error) {
+		g.Expect(*input.Bucket).To(Equal(testBucketName))
+		g.Expect(*input.Key).To(Equal("1234"))
+		g.Expect(*input.Range).To(Equal("bytes=10-19"))
+		return getObjectFromBytes(g, contents, input)
+	}).Times(1)
+
+	c := client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	reader, err := c.FetchReader(ctx, ObjectIndex{File: "1234", Offset: 10, Length: 10})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = reader.Close() }()
+
+	b, err := io.ReadAll(reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(b)).To(Equal("bbbbbbbbbb"))
+}
+
+func TestClient_FetchSSECustomerKey(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctx := context.Background()
+	contents := []byte("aaaaaaaaaabbbbbbbbbb")
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(options *s3.Options)) (*s3.GetObjectOutput, error) {
+		g.Expect(input.SSECustomerAlgorithm).To(Equal(aws.String("AES256")))
+		g.Expect(input.SSECustomerKey).To(Equal(aws.String("AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=")))
+		g.Expect(input.SSECustomerKeyMD5).To(Equal(aws.String("4Funlf7OsLF0HL+vKU+fkg==")))
+		return getObjectFromBytes(g, contents, input)
+	}).Times(1)
+
+	c := client[string]{
+		idCodec:       StringKeyCodec[string](),
+		clientOptions: clientOptions{sseCustomerKey: newSSECustomerKey(bytes.Repeat([]byte{0x01}, 32))},
+		s3Bucket:      testBucketName,
+		s3Client:      s3Mock,
+	}
+
+	b, err := c.Fetch(ctx, ObjectIndex{File: "1234", Offset: 10, Length: 10})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(b)).To(Equal("bbbbbbbbbb"))
+}
+
+func TestClient_FetchReaderError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).Return(nil, errors.New("error connecting to s3")).Times(1)
+
+	c := client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	reader, err := c.FetchReader(ctx, ObjectIndex{File: "1234", Offset: 0, Length: 120})
+	g.Expect(err).To(MatchError("failed to download object from file test-bucket/1234 bytes=0-119: error connecting to s3"))
+	g.Expect(reader).To(BeNil())
+}
+
+func TestClient_FetchMany(t *testing.T) {
+	// Two files, with 3 and 2 objects of 10 bytes each
+	files := map[string][]byte{
+		"file-a": []byte("aaaaaaaaaabbbbbbbbbbcccccccccc"),
+		"file-b": []byte("ddddddddddeeeeeeeeee"),
+	}
+
+	tests := []struct {
+		name           string
+		maxGap         uint64
+		inds           []ObjectIndex
+		expectedRanges []string
+		expected       []string
+	}{
+		{
+			name: "contiguous objects are fetched with a single request",
+			inds: []ObjectIndex{
+				{File: "file-a", Offset: 10, Length: 10},
+				{File: "file-a", Offset: 0, Length: 10},
+			},
+			expectedRanges: []string{"file-a bytes=0-19"},
+			expected:       []string{"bbbbbbbbbb", "aaaaaaaaaa"},
+		},
+		{
+			name: "objects with a gap are fetched separately",
+			inds: []ObjectIndex{
+				{File: "file-a", Offset: 0, Length: 10},
+				{File: "file-a", Offset: 20, Length: 10},
+			},
+			expectedRanges: []string{"file-a bytes=0-9", "file-a bytes=20-29"},
+			expected:       []string{"aaaaaaaaaa", "cccccccccc"},
+		},
+		{
+			name:   "objects within the max gap are merged",
+			maxGap: 10,
+			inds: []ObjectIndex{
+				{File: "file-a", Offset: 20, Length: 10},
+				{File: "file-a", Offset: 0, Length: 10},
+			},
+			expectedRanges: []string{"file-a bytes=0-29"},
+			expected:       []string{"cccccccccc", "aaaaaaaaaa"},
+		},
+		{
+			name:   "objects from different files are never merged",
+			maxGap: 100,
+			inds: []ObjectIndex{
+				{File: "file-b", Offset: 10, Length: 10},
+				{File: "file-a", Offset: 10, Length: 10},
+				{File: "file-b", Offset: 0, Length: 10},
+				{File: "file-a", Offset: 10, Length: 10},
+			},
+			expectedRanges: []string{"file-a bytes=10-19", "file-b bytes=0-19"},
+			expected:       []string{"eeeeeeeeee", "bbbbbbbbbb", "dddddddddd", "bbbbbbbbbb"},
+		},
+		{
+			name:     "empty objects are not downloaded",
+			inds:     []ObjectIndex{{File: "file-a", Offset: 10, Length: 0}},
+			expected: []string{""},
+		},
+		{
+			name:     "no indexes",
+			inds:     []ObjectIndex{},
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			var requestedRanges []string
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(options *s3.Options)) (*s3.GetObjectOutput, error) {
+				requestedRanges = append(requestedRanges, *input.Key+" "+*input.Range)
+				return getObjectFromBytes(g, files[*input.Key], input)
+			}).Times(len(test.expectedRanges))
+
+			c := client[string]{
+				idCodec:       StringKeyCodec[string](),
+				clientOptions: clientOptions{fetchMaxGap: test.maxGap},
+				s3Bucket:      testBucketName,
+				s3Client:      s3Mock,
+			}
+
+			results, err := c.FetchMany(ctx, test.inds)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(requestedRanges).To(ConsistOf(test.expectedRanges))
+			g.Expect(results).To(HaveLen(len(test.expected)))
+			for i, expected := range test.expected {
+				g.Expect(string(results[i])).To(Equal(expected))
+			}
+		})
+	}
+}
+
+func TestClient_FetchManyError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).Return(nil, errors.New("error connecting to s3")).Times(1)
+
+	c := client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	results, err := c.FetchMany(ctx, []ObjectIndex{
+		{File: "1234", Offset: 0, Length: 120},
+		{File: "1234", Offset: 120, Length: 10},
+	})
+	g.Expect(err).To(MatchError("failed to download object from file test-bucket/1234 bytes=0-129: error connecting to s3"))
+	g.Expect(results).To(BeNil())
+}
+
+// getObjectFromBytes simulates a s3 GetObject call over the given file contents, honoring the requested range.
+func getObjectFromBytes(g *WithT, contents []byte, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	g.Expect(contents).ToNot(BeNil(), fmt.Sprintf("file %s does not exist", *input.Key))
+	body := contents
+	if input.Range != nil && strings.HasPrefix(*input.Range, "bytes=-") {
+		var suffix int
+		_, err := fmt.Sscanf(*input.Range, "bytes=-%d", &suffix)
+		g.Expect(err).ToNot(HaveOccurred(), fmt.Sprintf("input range %s is not a valid range", *input.Range))
+		body = contents[max(len(contents)-suffix, 0):]
+	} else if input.Range != nil {
+		var start, end int
+		_, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end)
+		g.Expect(err).ToNot(HaveOccurred(), fmt.Sprintf("input range %s is not a valid range", *input.Range))
+		body = contents[start:min(end+1, len(contents))]
+	}
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
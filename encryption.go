@@ -0,0 +1,109 @@
+package s3batchstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// EncryptionAES256GCM is the encryption used for the objects of files created with WithEncryption.
+// Each object is sealed with AES-GCM, using a 256 bits data key per file, and a random nonce per object.
+const EncryptionAES256GCM = "AES256-GCM"
+
+// dataKeySize is the size in bytes of the data keys generated to encrypt the files
+const dataKeySize = 32
+
+// KeyProvider generates and unwraps the data keys used to encrypt the objects (envelope encryption).
+// Implementations would usually rely on a KMS, where the master key never leaves the service.
+type KeyProvider interface {
+	// GenerateDataKey returns a new random 256 bits data key, both in plaintext, and wrapped (encrypted) with the
+	// master key. The wrapped key is stored in the ObjectIndex, while the plaintext key is only kept in memory.
+	GenerateDataKey(ctx context.Context) (plaintext, wrapped []byte, err error)
+
+	// DecryptDataKey unwraps a data key that was returned by GenerateDataKey.
+	DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// staticKeyProvider is a KeyProvider that wraps the data keys with AES-GCM using a master key held in memory.
+type staticKeyProvider struct {
+	aead cipher.AEAD
+}
+
+// NewStaticKeyProvider creates a KeyProvider that wraps the data keys with a local master key, which must be
+// 16, 24 or 32 bytes long. It is mostly intended for tests and local development, as the master key has to be
+// available to the process.
+func NewStaticKeyProvider(masterKey []byte) (KeyProvider, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	return &staticKeyProvider{aead: aead}, nil
+}
+
+func (p *staticKeyProvider) GenerateDataKey(_ context.Context) ([]byte, []byte, error) {
+	plaintext := make([]byte, dataKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := seal(p.aead, plaintext, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, wrapped, nil
+}
+
+func (p *staticKeyProvider) DecryptDataKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	return open(p.aead, wrapped, nil)
+}
+
+// newAEAD creates an AES-GCM cipher with the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext with a random nonce, returning the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open is the inverse of seal.
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// dataKey returns the cipher for the data key wrapped in the index, unwrapping it with the client KeyProvider.
+// The unwrapped keys are cached, as all the objects of a file share the same data key.
+func (c *client[K]) dataKey(ctx context.Context, ind ObjectIndex) (cipher.AEAD, error) {
+	if c.keyProvider == nil {
+		return nil, errors.New("object is encrypted, but the client has no KeyProvider")
+	}
+	if aead, ok := c.dataKeyCache.Get(string(ind.WrappedKey)); ok {
+		return aead, nil
+	}
+
+	plaintext, err := c.keyProvider.DecryptDataKey(ctx, ind.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	aead, err := newAEAD(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	c.dataKeyCache.Add(string(ind.WrappedKey), aead)
+	return aead, nil
+}
@@ -0,0 +1,145 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+var testMasterKey = bytes.Repeat([]byte{0x42}, 32)
+
+func TestStaticKeyProvider(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	kp, err := NewStaticKeyProvider(testMasterKey)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	plaintext, wrapped, err := kp.GenerateDataKey(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(plaintext).To(HaveLen(dataKeySize))
+	g.Expect(wrapped).ToNot(ContainSubstring(string(plaintext)))
+
+	unwrapped, err := kp.DecryptDataKey(ctx, wrapped)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(unwrapped).To(Equal(plaintext))
+
+	// A different master key can't unwrap the data key
+	otherKp, err := NewStaticKeyProvider(bytes.Repeat([]byte{0x24}, 32))
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = otherKp.DecryptDataKey(ctx, wrapped)
+	g.Expect(err).To(MatchError("cipher: message authentication failed"))
+
+	_, err = kp.DecryptDataKey(ctx, []byte("short"))
+	g.Expect(err).To(MatchError("ciphertext too short"))
+
+	_, err = NewStaticKeyProvider([]byte("too short"))
+	g.Expect(err).To(MatchError("invalid master key: crypto/aes: invalid key size 9"))
+}
+
+func TestClient_FetchEncrypted(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	kp, err := NewStaticKeyProvider(testMasterKey)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := NewClient[string](aws.Config{}, testBucketName,
+		WithKeyProvider(kp),
+		WithTempFileOptions(WithCompression(CodecZstd), WithChecksums(), WithEncryption(kp)),
+	).(*client[string])
+	c.s3Client = s3Mock
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	payloads := map[string][]byte{
+		"1": bytes.Repeat([]byte("my first payload "), 10),
+		"2": bytes.Repeat([]byte("my second payload "), 10),
+	}
+	for id, payload := range payloads {
+		index, err := file.AppendAndReturnIndex(id, payload)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(index.Encryption).To(Equal(EncryptionAES256GCM))
+		g.Expect(index.WrappedKey).To(Equal(file.wrappedKey))
+		g.Expect(index.Codec).To(Equal(CodecZstd))
+		g.Expect(index.CRC32C).ToNot(BeNil())
+	}
+	contents := tempFileContents(g, file)
+	g.Expect(contents).ToNot(ContainSubstring("payload"))
+
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(options *s3.Options)) (*s3.GetObjectOutput, error) {
+		return getObjectFromBytes(g, contents, input)
+	}).AnyTimes()
+
+	for id, ind := range file.Indexes() {
+		b, err := c.Fetch(ctx, ind)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(b).To(Equal(payloads[id]))
+
+		reader, err := c.FetchReader(ctx, ind)
+		g.Expect(err).ToNot(HaveOccurred())
+		b, err = io.ReadAll(reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(b).To(Equal(payloads[id]))
+		g.Expect(reader.Close()).To(Succeed())
+	}
+	// All the objects share the same data key, so it is only unwrapped once
+	g.Expect(c.dataKeyCache.Len()).To(Equal(1))
+
+	// The objects are bound to their file, so an index pointing to another file can't be decrypted
+	ind := file.Indexes()["1"]
+	ind.File = "other-file"
+	_, err = c.Fetch(ctx, ind)
+	g.Expect(err).To(MatchError("failed to decrypt object in file other-file " + byteRangeString(ind.Offset, ind.Length) + ": cipher: message authentication failed"))
+
+	// A client without a KeyProvider can't decrypt the objects
+	noKeyClient := &client[string]{idCodec: StringKeyCodec[string](), s3Bucket: testBucketName, s3Client: s3Mock}
+	ind = file.Indexes()["1"]
+	_, err = noKeyClient.Fetch(ctx, ind)
+	g.Expect(err).To(MatchError("failed to decrypt object in file " + ind.File + " " + byteRangeString(ind.Offset, ind.Length) + ": object is encrypted, but the client has no KeyProvider"))
+
+	// A client with only a KeyProvider decrypts the objects, but doesn't encrypt its files
+	decryptClient := NewClient[string](aws.Config{}, testBucketName, WithKeyProvider(kp)).(*client[string])
+	plainFile, err := decryptClient.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = plainFile.Close() }()
+	index, err := plainFile.AppendAndReturnIndex("1", []byte("my payload"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.Encryption).To(BeEmpty())
+	g.Expect(index.WrappedKey).To(BeNil())
+}
+
+// slowKeyProvider is a KeyProvider that takes longer than the context to generate the data keys.
+type slowKeyProvider struct {
+	KeyProvider
+}
+
+func (p slowKeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func TestNewTempFile_DataKeyTimeout(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	kp, err := NewStaticKeyProvider(testMasterKey)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	file, err := NewTempFile[string](testTags, WithEncryption(slowKeyProvider{kp}), WithDataKeyTimeout(10*time.Millisecond))
+	g.Expect(err).To(MatchError(context.DeadlineExceeded))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to generate data key")))
+	g.Expect(file).To(BeNil())
+}
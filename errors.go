@@ -0,0 +1,133 @@
+package s3batchstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrObjectNotFound is returned when the requested object ID is not part of the file.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrBatcherClosed is returned when using a Batcher that was already closed.
+var ErrBatcherClosed = errors.New("batcher is closed")
+
+// CorruptionError is returned when the bytes downloaded for an object don't match the checksum in its ObjectIndex.
+// This usually means that the index doesn't point to the right bytes of the file, for example if a wrong offset
+// was stored.
+type CorruptionError struct {
+	Index    ObjectIndex
+	Expected uint32 // The CRC32C checksum stored in the index
+	Actual   uint32 // The CRC32C checksum of the downloaded bytes
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("object in file %s %s is corrupted: expected crc32c %08x, got %08x",
+		e.Index.File, byteRangeString(e.Index.Offset, e.Index.Length), e.Expected, e.Actual)
+}
+
+// ErrDuplicateID is matched by the *DuplicateIDError returned when appending an object with DuplicateReject.
+var ErrDuplicateID = errors.New("duplicate object id")
+
+// DuplicateIDError is returned when appending an object with an id that is already in a file that uses
+// DuplicateReject.
+type DuplicateIDError struct {
+	ID   any    // The duplicated id
+	File string // The key of the file
+}
+
+func (e *DuplicateIDError) Error() string {
+	return fmt.Sprintf("%s: id %v is already in file %s", ErrDuplicateID, e.ID, e.File)
+}
+
+func (e *DuplicateIDError) Is(target error) bool {
+	return target == ErrDuplicateID
+}
+
+// ErrAlreadyExists is returned by UploadFile when using WithNoOverwrite, if the file already exists in s3 and it is
+// not the same file.
+var ErrAlreadyExists = errors.New("file already exists")
+
+// ErrNoChecksum is returned by VerifyFile when the file was not uploaded with WithChecksumAlgorithm.
+var ErrNoChecksum = errors.New("file has no checksum")
+
+// ChecksumMismatchError is returned by VerifyFile when the checksum of the downloaded file doesn't match the one
+// computed when it was uploaded.
+type ChecksumMismatchError struct {
+	File      string                  // The key of the file
+	Algorithm types.ChecksumAlgorithm // The algorithm used to compute the checksums
+	Expected  string                  // The base64 encoded checksum computed when uploading the file
+	Actual    string                  // The base64 encoded checksum of the downloaded file
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("file %s is corrupted: expected %s checksum %s, got %s",
+		e.File, e.Algorithm, e.Expected, e.Actual)
+}
+
+// UploadError is returned by UploadFile when using WithRollback, if the meta file could not be uploaded.
+// The files written by the failed call are deleted to roll back the upload. Remaining lists the ones written by
+// the call that may still exist in s3, and Existing the ones that were already in s3 (see WithNoOverwrite), which
+// are kept.
+type UploadError struct {
+	File        string   // The key of the data file
+	Deleted     []string // The keys of the files deleted by the rollback
+	Remaining   []string // The keys of the files written by the failed call that may still exist in s3
+	Existing    []string // The keys of the files that already existed in s3, which were kept
+	Err         error    // The error that made the upload fail
+	RollbackErr error    // The error of the last attempt to delete the files, nil if the rollback succeeded
+}
+
+func (e *UploadError) Error() string {
+	var msg string
+	switch {
+	case e.RollbackErr != nil:
+		msg = fmt.Sprintf("%s, and failed to roll back the upload of file %s: %s", e.Err, e.File, e.RollbackErr)
+	case len(e.Deleted) > 0:
+		msg = fmt.Sprintf("%s, the upload of file %s was rolled back", e.Err, e.File)
+	default:
+		msg = fmt.Sprintf("%s, nothing was deleted to roll back the upload of file %s", e.Err, e.File)
+	}
+	if len(e.Existing) > 0 {
+		msg += fmt.Sprintf(", the files that already existed were kept: %s", strings.Join(e.Existing, ", "))
+	}
+	if e.RollbackErr == nil && len(e.Remaining) > 0 {
+		msg += fmt.Sprintf(", the files that may still exist: %s", strings.Join(e.Remaining, ", "))
+	}
+	return msg
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidTag describes a tag that doesn't respect the s3 tagging limits.
+type InvalidTag struct {
+	Key    string
+	Value  string
+	Reason string // Why the tag is not valid
+}
+
+// TagValidationError is returned by NewTempFile when the tags don't respect the s3 tagging limits, which would make
+// the upload fail: at most 10 tags, keys of up to 128 characters not starting with "aws:", values of up to 256
+// characters, and only letters, numbers, spaces and the characters _ . : / = + - @.
+type TagValidationError struct {
+	Count   int          // The number of tags
+	Invalid []InvalidTag // The tags that are not valid, sorted by key
+}
+
+func (e *TagValidationError) Error() string {
+	var problems []string
+	if e.Count > maxTags {
+		problems = append(problems, fmt.Sprintf("%d tags, the limit is %d", e.Count, maxTags))
+	}
+	for _, tag := range e.Invalid {
+		problems = append(problems, fmt.Sprintf("tag %q: %s", tag.Key, tag.Reason))
+	}
+	return "invalid tags: " + strings.Join(problems, "; ")
+}
+
+// ErrNoFooter is returned by ReadFooter when the file was not uploaded with WithFooterIndex.
+var ErrNoFooter = errors.New("file has no footer index")
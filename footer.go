@@ -0,0 +1,121 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// footerTrailerSize is the size of the trailer at the end of a file with a footer index, which holds the offset
+	// and the length of the footer, followed by footerMagic, as big endian uint64s.
+	footerTrailerSize = 24
+	// footerMagic identifies the files that end with a footer index, it spells "S3BFOOT1"
+	footerMagic uint64 = 0x533342464f4f5431
+	// footerReadSize is the number of bytes downloaded from the end of the file by ReadFooter, so that small
+	// footers only need one request.
+	footerReadSize = 64 * 1024
+)
+
+// WithFooterIndex makes UploadFile append the index of the file as a footer to the data file, followed by a fixed
+// size trailer, so that the uploaded file is self-describing and ReadFooter can read its index without a meta file.
+// The footer has the same contents as a MetaFileV2 meta file, without the whole file checksum.
+// The objects keep their offsets, and any checksum computed with WithChecksumAlgorithm covers the footer too.
+// Combined with withMetaFile=false, this saves one PutObject request per file.
+func WithFooterIndex() UploadOption {
+	return func(o *uploadOptions) {
+		o.footerIndex = true
+	}
+}
+
+// encodeFooter returns the footer index of the given file, including the trailer.
+func encodeFooter[K comparable](file *TempFile[K], codec KeyCodec[K]) ([]byte, error) {
+	metaBody, err := encodeMetaFile(newMetaFile(file, "", ""), MetaFileV2, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, len(metaBody)+footerTrailerSize)
+	copy(footer, metaBody)
+	trailer := footer[len(metaBody):]
+	binary.BigEndian.PutUint64(trailer[0:8], file.offset)
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(len(metaBody)))
+	binary.BigEndian.PutUint64(trailer[16:24], footerMagic)
+	return footer, nil
+}
+
+// footerReaderAt reads the contents of a data file followed by its footer, without copying the data file.
+type footerReaderAt struct {
+	data   io.ReaderAt
+	size   int64 // The size of the data file
+	footer []byte
+}
+
+func (r *footerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("footerReaderAt.ReadAt: negative offset")
+	}
+
+	n := 0
+	if off < r.size {
+		dataPart := p[:min(int64(len(p)), r.size-off)]
+		var err error
+		if n, err = r.data.ReadAt(dataPart, off); n < len(dataPart) {
+			return n, err
+		}
+	}
+	if footerOffset := off + int64(n) - r.size; footerOffset >= 0 && footerOffset < int64(len(r.footer)) {
+		n += copy(p[n:], r.footer[footerOffset:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *client[K]) ReadFooter(ctx context.Context, fileKey string) (*MetaFile[K], error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.s3Bucket),
+		Key:    aws.String(fileKey),
+		Range:  aws.String(fmt.Sprintf("bytes=-%d", footerReadSize)),
+	}
+	c.sseCustomerKey.applyToGet(input)
+	result, err := c.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the footer of file %s/%s: %w", c.s3Bucket, fileKey, err)
+	}
+	defer func() { _ = result.Body.Close() }()
+	suffix, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the footer of file %s/%s: %w", c.s3Bucket, fileKey, err)
+	}
+
+	if len(suffix) < footerTrailerSize || binary.BigEndian.Uint64(suffix[len(suffix)-8:]) != footerMagic {
+		return nil, fmt.Errorf("%w: file %s/%s", ErrNoFooter, c.s3Bucket, fileKey)
+	}
+	trailer := suffix[len(suffix)-footerTrailerSize:]
+	offset := binary.BigEndian.Uint64(trailer[0:8])
+	length := binary.BigEndian.Uint64(trailer[8:16])
+
+	var footer []byte
+	if before := suffix[:len(suffix)-footerTrailerSize]; length <= uint64(len(before)) {
+		footer = before[uint64(len(before))-length:]
+	} else {
+		// The footer is larger than the downloaded suffix, download it using its offset
+		if footer, err = c.fetchRange(ctx, fileKey, offset, length); err != nil {
+			return nil, err
+		}
+	}
+
+	metaFile, err := decodeMetaFile(bytes.NewReader(footer), c.idCodec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the footer of file %s/%s: %w", c.s3Bucket, fileKey, err)
+	}
+	return metaFile, nil
+}
@@ -0,0 +1,246 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestFooterReaderAt(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	r := &footerReaderAt{data: strings.NewReader("data file"), size: 9, footer: []byte(" and footer")}
+	g.Expect(iotest.TestReader(io.NewSectionReader(r, 0, 20), []byte("data file and footer"))).To(Succeed())
+
+	// Reads that span the data file and the footer
+	buf := make([]byte, 8)
+	n, err := r.ReadAt(buf, 5)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(buf[:n])).To(Equal("file and"))
+
+	n, err = r.ReadAt(buf, 16)
+	g.Expect(err).To(Equal(io.EOF))
+	g.Expect(string(buf[:n])).To(Equal("oter"))
+
+	n, err = r.ReadAt(buf, 30)
+	g.Expect(err).To(Equal(io.EOF))
+	g.Expect(n).To(BeZero())
+
+	_, err = r.ReadAt(buf, -1)
+	g.Expect(err).To(MatchError("footerReaderAt.ReadAt: negative offset"))
+}
+
+func TestClient_UploadFileWithFooterIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects int
+		idSize  int
+		gets    int // The number of requests to read the footer
+	}{
+		{
+			name:    "small footer",
+			objects: 3,
+			idSize:  4,
+			gets:    1,
+		},
+		{
+			name:    "footer larger than the downloaded suffix",
+			objects: 5000,
+			idSize:  32,
+			gets:    2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			file, err := c.NewTempFile(testTags)
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+			for range test.objects {
+				// Random ids, so that the footer doesn't compress too well
+				id := make([]byte, test.idSize/2)
+				_, err = rand.Read(id)
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(file.Append(hex.EncodeToString(id), []byte("payload "+hex.EncodeToString(id)))).To(Succeed())
+			}
+			contents := tempFileContents(g, file)
+
+			// Only the data file is uploaded, and it includes the footer
+			var uploaded []byte
+			s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.fileName)).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+				uploaded, err = io.ReadAll(input.Body)
+				g.Expect(err).ToNot(HaveOccurred())
+				checksum, err := computeChecksum(types.ChecksumAlgorithmCrc32c, bytes.NewReader(uploaded))
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(input.ChecksumCRC32C).To(HaveValue(Equal(checksum)))
+				return &s3.PutObjectOutput{}, nil
+			})
+			err = c.UploadFile(ctx, file, false, WithFooterIndex(), WithChecksumAlgorithm(types.ChecksumAlgorithmCrc32c))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(uploaded).To(HavePrefix(string(contents)))
+
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				g.Expect(*input.Key).To(Equal(file.fileName))
+				return getObjectFromBytes(g, uploaded, input)
+			}).Times(test.gets)
+
+			metaFile, err := c.ReadFooter(ctx, file.fileName)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(metaFile.Entries).To(Equal(file.Indexes()))
+			g.Expect(metaFile.Header.Count).To(Equal(test.objects))
+			g.Expect(metaFile.Header.Size).To(Equal(file.Size()))
+			g.Expect(metaFile.Header.Tags).To(Equal(testTags))
+		})
+	}
+}
+
+func TestClient_LoadIndexesFromFooter(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "no such key", err: &types.NoSuchKey{}},
+		// s3 returns AccessDenied for missing keys when the caller doesn't have the s3:ListBucket permission
+		{name: "access denied", err: &smithy.GenericAPIError{Code: "AccessDenied"}},
+		{name: "forbidden", err: &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusForbidden}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			file, err := c.NewTempFile(testTags)
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+			g.Expect(file.Append("a", []byte("first"))).To(Succeed())
+			g.Expect(file.Append("b", []byte("second"))).To(Succeed())
+
+			var uploaded []byte
+			s3Mock.EXPECT().PutObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+				uploaded, err = io.ReadAll(input.Body)
+				return &s3.PutObjectOutput{}, err
+			})
+			g.Expect(c.UploadFile(ctx, file, false, WithFooterIndex())).To(Succeed())
+
+			// The meta file doesn't exist, so the index is read from the footer
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				if *input.Key == file.MetaFileKey() {
+					return nil, test.err
+				}
+				return getObjectFromBytes(g, uploaded, input)
+			}).Times(3)
+
+			payload, err := c.FetchByID(ctx, file.fileName, "b")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(string(payload)).To(Equal("second"))
+		})
+	}
+}
+
+func TestClient_ReadFooterError(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+		err      error
+		errMsg   any
+		noFooter bool
+	}{
+		{
+			name:   "s3 download error",
+			err:    errors.New("error connecting to s3"),
+			errMsg: "failed to download the footer of file test-bucket/file: error connecting to s3",
+		},
+		{
+			name:     "file without footer",
+			contents: bytes.Repeat([]byte("a"), 100),
+			errMsg:   "file has no footer index: file test-bucket/file",
+			noFooter: true,
+		},
+		{
+			name:     "file smaller than the trailer",
+			contents: []byte("a"),
+			errMsg:   "file has no footer index: file test-bucket/file",
+			noFooter: true,
+		},
+		{
+			name:     "invalid footer",
+			contents: append([]byte("not zstd"), encodeTrailer(0, 8)...),
+			errMsg:   ContainSubstring("failed to read the footer of file test-bucket/file: "),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				if test.err != nil {
+					return nil, test.err
+				}
+				return getObjectFromBytes(g, test.contents, input)
+			}).Times(1)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			metaFile, err := c.ReadFooter(ctx, "file")
+			g.Expect(err).To(MatchError(test.errMsg))
+			if test.noFooter {
+				g.Expect(err).To(MatchError(ErrNoFooter))
+			}
+			g.Expect(metaFile).To(BeNil())
+		})
+	}
+}
+
+// encodeTrailer returns the trailer of a footer index with the given offset and length
+func encodeTrailer(offset, length uint64) []byte {
+	trailer := make([]byte, 0, footerTrailerSize)
+	trailer = binary.BigEndian.AppendUint64(trailer, offset)
+	trailer = binary.BigEndian.AppendUint64(trailer, length)
+	return binary.BigEndian.AppendUint64(trailer, footerMagic)
+}
@@ -0,0 +1,274 @@
+package s3batchstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalSuffix is appended to the path of a temp file to build the path of its journal
+const journalSuffix = ".s3batch.journal"
+
+// scratchSuffix ends the names of the scratch files created next to a temp file, see WithAppendReaderScratch
+const scratchSuffix = ".s3batch.scratch"
+
+// journalVersion is the version of the journal format, stored in its header
+const journalVersion = 1
+
+// JournalSyncPolicy defines when the journal of a TempFile is flushed to disk.
+type JournalSyncPolicy int
+
+const (
+	// JournalSyncNone leaves flushing the data file and the journal to the OS. The objects survive a crash of the
+	// process, but not a crash of the OS or a power loss. This is the default.
+	JournalSyncNone JournalSyncPolicy = iota
+	// JournalSyncAlways flushes the data file and the journal to disk (fsync) after every append, so the objects
+	// survive a crash of the OS, at the cost of much slower appends.
+	JournalSyncAlways
+)
+
+// WithJournal makes the TempFile record the id and index of each appended object in a journal next to the temp
+// file, flushed to disk according to the given policy. If the process dies before the file is uploaded, the file
+// can be recovered with RecoverTempFiles. Closing the file deletes its journal.
+// The journal is only supported when the contents are stored in a file (the default, or WithTempDir).
+// The ids are stored in the journal with a KeyCodec, see WithJournalKeyCodec.
+func WithJournal(sync JournalSyncPolicy) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.journal = true
+		o.journalSync = sync
+	}
+}
+
+// WithJournalKeyCodec sets the KeyCodec used to store the object ids in the journal, which must be a KeyCodec[K]
+// for the K of the TempFile. It defaults to the same codec as the meta files, see WithKeyCodec, and the Client
+// NewTempFile method uses the codec of the client. The same codec must be passed to RecoverTempFiles.
+func WithJournalKeyCodec[K comparable](codec KeyCodec[K]) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.journalKeyCodec = codec
+	}
+}
+
+// journalHeader is the first line of a journal, with the information needed to rebuild the TempFile.
+type journalHeader struct {
+	Version         int               `json:"version"`
+	FileKey         string            `json:"file_key"`
+	CreatedOn       time.Time         `json:"created_on"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	DuplicatePolicy DuplicatePolicy   `json:"duplicate_policy,omitempty"`
+}
+
+// journalEntry is written to the journal as a json line for each appended object.
+type journalEntry struct {
+	ID    string      `json:"id"` // Encoded with the KeyCodec of the file
+	Index ObjectIndex `json:"index"`
+}
+
+// journal records the objects appended to a temp file. A nil *journal means that the file has no journal.
+type journal struct {
+	file *os.File
+	data *os.File // The temp file, flushed before each entry with JournalSyncAlways
+	sync JournalSyncPolicy
+}
+
+// newJournal creates the journal of the given temp file, and writes its header.
+func newJournal(data *os.File, header journalHeader, sync JournalSyncPolicy) (*journal, error) {
+	file, err := os.OpenFile(data.Name()+journalSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{file: file, data: data, sync: sync}
+	header.Version = journalVersion
+	if err = j.writeLine(header); err != nil {
+		return nil, errors.Join(err, j.remove())
+	}
+	return j, nil
+}
+
+// append records the index of an object, which must already be written to the temp file.
+// key is the id of the object encoded with the KeyCodec of the file.
+func (j *journal) append(key string, index ObjectIndex) error {
+	if j == nil {
+		return nil
+	}
+	if j.sync == JournalSyncAlways {
+		// The object bytes must be on disk before the entry that points to them
+		if err := j.data.Sync(); err != nil {
+			return err
+		}
+	}
+	return j.writeLine(journalEntry{ID: key, Index: index})
+}
+
+// writeLine writes v as a json line, with a single write so that a crash can only leave an incomplete last line.
+func (j *journal) writeLine(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if j.sync == JournalSyncAlways {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// remove closes and deletes the journal.
+func (j *journal) remove() error {
+	if j == nil {
+		return nil
+	}
+	err := j.file.Close()
+	if errors.Is(err, os.ErrClosed) {
+		err = nil
+	}
+	return errors.Join(err, os.Remove(j.file.Name()))
+}
+
+// RecoverTempFiles reopens the temp files left in dir by a process that died before uploading them, using their
+// journals (see WithJournal). K must be the same type used to create the files, and codec the KeyCodec used by their
+// journals, or nil for the default one of K.
+// The recovered files contain all the objects whose append completed, and are read-only, ready to be uploaded
+// with UploadFile and then closed, which deletes the temp file and its journal.
+// It must not be called while other TempFiles with a journal are in use in the same directory.
+// Files that can't be recovered are left untouched, and reported in the returned error, along with the
+// files that were recovered. Journals whose temp file no longer exists are deleted, as there's nothing to recover.
+// The scratch files left behind by AppendReader (see WithAppendReaderScratch) are deleted as well.
+func RecoverTempFiles[K comparable](dir string, codec KeyCodec[K]) ([]*TempFile[K], error) {
+	if codec == nil {
+		var err error
+		if codec, err = defaultKeyCodec[K](); err != nil {
+			return nil, err
+		}
+	}
+
+	journals, err := filepath.Glob(filepath.Join(dir, "*"+journalSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	scratchFiles, err := filepath.Glob(filepath.Join(dir, "*"+scratchSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*TempFile[K]
+	var errs []error
+	// The objects in the scratch files were never appended, so there's nothing to recover from them
+	for _, scratchPath := range scratchFiles {
+		if err := os.Remove(scratchPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to delete scratch file %s: %w", scratchPath, err))
+		}
+	}
+	for _, journalPath := range journals {
+		file, err := recoverTempFile(journalPath, codec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to recover temp file %s: %w", journalPath, err))
+			continue
+		}
+		if file != nil {
+			files = append(files, file)
+		}
+	}
+	return files, errors.Join(errs...)
+}
+
+// recoverTempFile rebuilds the TempFile of the given journal, replaying its entries.
+// If the temp file no longer exists, the journal is deleted and a nil file is returned.
+func recoverTempFile[K comparable](journalPath string, codec KeyCodec[K]) (*TempFile[K], error) {
+	journalFile, err := os.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(journalFile)
+
+	var header journalHeader
+	line, err := reader.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &header)
+	}
+	if err != nil {
+		_ = journalFile.Close()
+		return nil, fmt.Errorf("failed to read journal header: %w", err)
+	}
+	if header.Version != journalVersion {
+		_ = journalFile.Close()
+		return nil, fmt.Errorf("unsupported journal version %d", header.Version)
+	}
+
+	data, err := os.OpenFile(journalPath[:len(journalPath)-len(journalSuffix)], os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// The file was closed, but the process died before deleting its journal
+		return nil, (&journal{file: journalFile}).remove()
+	}
+	if err != nil {
+		_ = journalFile.Close()
+		return nil, err
+	}
+	info, err := data.Stat()
+	if err != nil {
+		_ = data.Close()
+		_ = journalFile.Close()
+		return nil, err
+	}
+
+	f := &TempFile[K]{
+		tempFileOptions: tempFileOptions{duplicatePolicy: header.DuplicatePolicy},
+		fileName:        header.FileKey,
+		file:            &diskStorage{File: data},
+		createdOn:       header.CreatedOn,
+		tags:            header.Tags,
+		readonly:        true,
+		indexes:         map[K]ObjectIndex{},
+		journal:         &journal{file: journalFile, data: data},
+	}
+
+	// Replay the entries until the first one that is incomplete or points to bytes that didn't make it to the
+	// data file, as nothing after it can be trusted.
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			_ = data.Close()
+			_ = journalFile.Close()
+			return nil, fmt.Errorf("failed to read journal: %w", err)
+		}
+
+		id, index, ok := decodeJournalEntry(line, codec)
+		if !ok ||
+			index.File != f.fileName ||
+			index.Offset != f.offset ||
+			index.Offset+index.Length > uint64(info.Size()) {
+			break
+		}
+		f.addIndexLocked(id, index)
+	}
+
+	// Discard the bytes of the objects whose append didn't complete
+	if err = f.truncateLocked(); err != nil {
+		_ = data.Close()
+		_ = journalFile.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// decodeJournalEntry parses a line of a journal, and returns whether it is a valid entry.
+func decodeJournalEntry[K comparable](line []byte, codec KeyCodec[K]) (K, ObjectIndex, bool) {
+	var entry journalEntry
+	if json.Unmarshal(line, &entry) != nil {
+		var id K
+		return id, ObjectIndex{}, false
+	}
+	id, err := codec.DecodeKey(entry.ID)
+	return id, entry.Index, err == nil
+}
@@ -0,0 +1,183 @@
+package s3batchstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRecoverTempFiles(t *testing.T) {
+	for _, sync := range []JournalSyncPolicy{JournalSyncNone, JournalSyncAlways} {
+		t.Run(fmt.Sprint(sync), func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			dir := t.TempDir()
+
+			file, err := NewTempFile[string](testTags,
+				WithTempDir(dir), WithJournal(sync), WithChecksums(), WithDuplicatePolicy(DuplicateKeepAll))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(file.Append("1", []byte("my first payload"), WithObjectContentType("text/plain"))).To(Succeed())
+			g.Expect(file.Append("2", []byte("my second payload"))).To(Succeed())
+			_, err = file.AppendReader("1", strings.NewReader("my first payload, again"))
+			g.Expect(err).ToNot(HaveOccurred())
+
+			// Simulate a crash in the middle of an append: the bytes of the object are written, but not its entry
+			_, err = file.file.Write([]byte("my lost payload"))
+			g.Expect(err).ToNot(HaveOccurred())
+			journalPath := file.file.Name() + journalSuffix
+			journalFile, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0)
+			g.Expect(err).ToNot(HaveOccurred())
+			_, err = journalFile.WriteString(`{"id":"3","ind`)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(journalFile.Close()).To(Succeed())
+			defer func() { _ = file.file.(*diskStorage).File.Close() }()
+
+			files, err := RecoverTempFiles[string](dir, nil)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(files).To(HaveLen(1))
+			recovered := files[0]
+			g.Expect(recovered.Name()).To(Equal(file.Name()))
+			g.Expect(recovered.Tags()).To(Equal(testTags))
+			g.Expect(recovered.createdOn.Equal(file.createdOn)).To(BeTrue())
+			g.Expect(recovered.Indexes()).To(Equal(file.Indexes()))
+			g.Expect(recovered.Versions("1")).To(Equal(file.Versions("1")))
+			g.Expect(recovered.Count()).To(Equal(uint(3)))
+			g.Expect(recovered.Duplicates()).To(Equal(uint(1)))
+			g.Expect(recovered.Size()).To(Equal(file.Size()))
+			g.Expect(string(tempFileContents(g, recovered))).To(Equal("my first payloadmy second payloadmy first payload, again"))
+
+			// The recovered file can only be uploaded
+			err = recovered.Append("4", []byte("my fourth payload"))
+			g.Expect(err).To(MatchError(fmt.Sprintf("file %s is readonly", file.fileName)))
+
+			// Closing the file deletes it along with its journal
+			g.Expect(recovered.Close()).To(Succeed())
+			entries, err := os.ReadDir(dir)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(entries).To(BeEmpty())
+		})
+	}
+}
+
+func TestRecoverTempFiles_Errors(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := t.TempDir()
+
+	file, err := NewTempFile[string](testTags, WithTempDir(dir), WithJournal(JournalSyncNone))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(file.Append("1", []byte("payload"))).To(Succeed())
+	defer func() { _ = file.file.(*diskStorage).File.Close() }()
+
+	invalidJournal := filepath.Join(dir, "invalid"+journalSuffix)
+	g.Expect(os.WriteFile(invalidJournal, []byte("not json\n"), 0o600)).To(Succeed())
+	orphanJournal := filepath.Join(dir, "orphan"+journalSuffix)
+	g.Expect(os.WriteFile(orphanJournal, []byte(`{"version":1,"file_key":"orphan"}`+"\n"), 0o600)).To(Succeed())
+	futureJournal := filepath.Join(dir, "future"+journalSuffix)
+	g.Expect(os.WriteFile(futureJournal, []byte(`{"version":2,"file_key":"future"}`+"\n"), 0o600)).To(Succeed())
+	scratchFile := file.file.Name() + ".123" + scratchSuffix
+	g.Expect(os.WriteFile(scratchFile, []byte("partial payload"), 0o600)).To(Succeed())
+
+	// The valid files are recovered, the journals without a temp file and the scratch files are deleted, and the
+	// others are reported and left untouched
+	files, err := RecoverTempFiles[string](dir, nil)
+	g.Expect(files).To(HaveLen(1))
+	g.Expect(files[0].Indexes()).To(Equal(file.Indexes()))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to recover temp file " + invalidJournal + ": failed to read journal header")))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to recover temp file " + futureJournal + ": unsupported journal version 2")))
+	g.Expect(err).ToNot(MatchError(ContainSubstring(orphanJournal)))
+	g.Expect(invalidJournal).To(BeAnExistingFile())
+	g.Expect(orphanJournal).ToNot(BeAnExistingFile())
+	g.Expect(scratchFile).ToNot(BeAnExistingFile())
+	g.Expect(files[0].Close()).To(Succeed())
+}
+
+// journalTestID is an id that can't be stored as json, as its fields are unexported.
+type journalTestID struct {
+	tenant string
+	id     int
+}
+
+// journalTestCodec is a KeyCodec for journalTestID.
+type journalTestCodec struct{}
+
+func (journalTestCodec) EncodeKey(id journalTestID) (string, error) {
+	return fmt.Sprintf("%s/%d", id.tenant, id.id), nil
+}
+
+func (journalTestCodec) DecodeKey(key string) (journalTestID, error) {
+	tenant, id, ok := strings.Cut(key, "/")
+	if !ok {
+		return journalTestID{}, fmt.Errorf("invalid key %q", key)
+	}
+	var n int
+	_, err := fmt.Sscan(id, &n)
+	return journalTestID{tenant: tenant, id: n}, err
+}
+
+func TestRecoverTempFiles_KeyCodec(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := t.TempDir()
+
+	// The client NewTempFile method uses the codec of the client for the journal
+	c := &client[journalTestID]{idCodec: journalTestCodec{}}
+	file, err := c.NewTempFile(testTags, WithTempDir(dir), WithJournal(JournalSyncNone))
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.file.(*diskStorage).File.Close() }()
+	g.Expect(file.Append(journalTestID{tenant: "a", id: 1}, []byte("first"))).To(Succeed())
+	g.Expect(file.Append(journalTestID{tenant: "b", id: 1}, []byte("second"))).To(Succeed())
+
+	files, err := RecoverTempFiles[journalTestID](dir, journalTestCodec{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(files).To(HaveLen(1))
+	defer func() { _ = files[0].Close() }()
+	g.Expect(files[0].Indexes()).To(Equal(file.Indexes()))
+	g.Expect(files[0].Indexes()).To(HaveLen(2))
+
+	// Without a codec the ids can't be stored, so the journal is rejected
+	_, err = NewTempFile[journalTestID](testTags, WithTempDir(dir), WithJournal(JournalSyncNone))
+	g.Expect(err).To(MatchError("failed to create journal: ids of type s3batchstore.journalTestID have no default " +
+		"key codec, configure one with WithKeyCodec"))
+	_, err = RecoverTempFiles[journalTestID](dir, nil)
+	g.Expect(err).To(MatchError("ids of type s3batchstore.journalTestID have no default key codec, configure one with WithKeyCodec"))
+}
+
+func TestNewTempFile_Journal(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	file, err := NewTempFile[string](testTags, WithJournal(JournalSyncNone))
+	g.Expect(err).ToNot(HaveOccurred())
+	journalPath := file.file.Name() + journalSuffix
+	g.Expect(journalPath).To(BeAnExistingFile())
+	g.Expect(file.Close()).To(Succeed())
+	g.Expect(journalPath).ToNot(BeAnExistingFile())
+
+	// Files without a journal don't create one
+	file, err = NewTempFile[string](testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.journal).To(BeNil())
+	g.Expect(file.file.Name() + journalSuffix).ToNot(BeAnExistingFile())
+
+	// The journal needs the contents to be stored in a file
+	_, err = NewTempFile[string](testTags, WithMemoryStorage(), WithJournal(JournalSyncNone))
+	g.Expect(err).To(MatchError("the journal is only supported when storing the file contents in a file"))
+}
+
+func TestFile_JournalWriteError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	file, err := NewTempFile[string](testTags, WithJournal(JournalSyncNone))
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("payload"))).To(Succeed())
+
+	// If the entry can't be written, the object is discarded
+	g.Expect(file.journal.file.Close()).To(Succeed())
+	err = file.Append("2", []byte("payload"))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to write the journal of file " + file.file.Name())))
+	g.Expect(file.Indexes()).ToNot(HaveKey("2"))
+	g.Expect(string(tempFileContents(g, file))).To(Equal("payload"))
+}
@@ -0,0 +1,206 @@
+package s3batchstore
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// KeyCodec converts the object ids to and from the strings used as keys in the meta files.
+// EncodeKey must return a different key for each id, and DecodeKey must return the original id.
+type KeyCodec[K comparable] interface {
+	EncodeKey(id K) (string, error)
+	DecodeKey(key string) (K, error)
+}
+
+// Integer is the set of integer types that can be used as ids with IntKeyCodec.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// StringKeyCodec returns a KeyCodec that uses the string ids as the keys.
+func StringKeyCodec[K ~string]() KeyCodec[K] {
+	return stringKeyCodec[K]{}
+}
+
+// IntKeyCodec returns a KeyCodec that formats the integer ids in base 10.
+func IntKeyCodec[K Integer]() KeyCodec[K] {
+	return intKeyCodec[K]{}
+}
+
+// TextKeyCodec returns a KeyCodec for ids that implement encoding.TextMarshaler and encoding.TextUnmarshaler,
+// like ULIDs and UUIDs.
+func TextKeyCodec[K comparable, P interface {
+	*K
+	encoding.TextMarshaler
+	encoding.TextUnmarshaler
+}]() KeyCodec[K] {
+	return textKeyCodec[K]{}
+}
+
+// JSONKeyCodec returns a KeyCodec that uses the json representation of the ids as the keys, which is useful for
+// composite ids like structs. The fields that are not serialized to json, like the unexported ones, are not part
+// of the key, so two ids that only differ in those fields would have the same key.
+func JSONKeyCodec[K comparable]() KeyCodec[K] {
+	return jsonKeyCodec[K]{}
+}
+
+// WithKeyCodec sets the KeyCodec used to store the object ids in the meta files, and in the journals of the files
+// created with the client NewTempFile method. The K of the codec must be the same as the one of the client.
+// By default, the codec is chosen from the type of the ids:
+//   - StringKeyCodec for string types.
+//   - TextKeyCodec for types that implement encoding.TextMarshaler and encoding.TextUnmarshaler.
+//   - IntKeyCodec for integer types.
+//   - JSONKeyCodec for booleans, floats, and structs and arrays made of those types, as long as every struct field
+//     is serialized to json.
+//
+// These produce the same keys as the json serialization of a map, which was used by previous versions of the meta
+// files. Other types, like pointers or interfaces, require a codec, otherwise NewClient panics.
+func WithKeyCodec[K comparable](codec KeyCodec[K]) ClientOption {
+	return func(o *clientOptions) {
+		o.keyCodec = codec
+	}
+}
+
+var (
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// resolveKeyCodec returns the KeyCodec configured with WithKeyCodec, or the default one for K if codec is nil.
+func resolveKeyCodec[K comparable](codec any) (KeyCodec[K], error) {
+	if codec == nil {
+		return defaultKeyCodec[K]()
+	}
+	keyCodec, ok := codec.(KeyCodec[K])
+	if !ok {
+		return nil, fmt.Errorf("the key codec %T doesn't support ids of type %s", codec, reflect.TypeFor[K]())
+	}
+	return keyCodec, nil
+}
+
+// defaultKeyCodec returns the KeyCodec used for the ids of type K when none is configured with WithKeyCodec.
+func defaultKeyCodec[K comparable]() (KeyCodec[K], error) {
+	t := reflect.TypeFor[K]()
+	switch {
+	case t.Kind() == reflect.String:
+		return stringKeyCodec[K]{}, nil
+	case isTextCodable(t):
+		return textKeyCodec[K]{}, nil
+	case isInteger(t):
+		return intKeyCodec[K]{}, nil
+	case isJSONCodable(t):
+		return jsonKeyCodec[K]{}, nil
+	default:
+		return nil, fmt.Errorf("ids of type %s have no default key codec, configure one with WithKeyCodec", t)
+	}
+}
+
+// isTextCodable returns whether the values of type t can be converted to and from text.
+func isTextCodable(t reflect.Type) bool {
+	return reflect.PointerTo(t).Implements(textMarshalerType) && reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+// isInteger returns whether t is an integer type.
+func isInteger(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	default:
+		return false
+	}
+}
+
+// isJSONCodable returns whether the values of type t can be converted to and from json without losing information,
+// so that different ids never have the same key.
+func isJSONCodable(t reflect.Type) bool {
+	if t.Kind() == reflect.String || isTextCodable(t) || isInteger(t) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Array:
+		return isJSONCodable(t.Elem())
+	case reflect.Struct:
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if !field.IsExported() || field.Tag.Get("json") == "-" || !isJSONCodable(field.Type) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+type stringKeyCodec[K comparable] struct{}
+
+func (stringKeyCodec[K]) EncodeKey(id K) (string, error) {
+	return reflect.ValueOf(id).String(), nil
+}
+
+func (stringKeyCodec[K]) DecodeKey(key string) (K, error) {
+	var id K
+	reflect.ValueOf(&id).Elem().SetString(key)
+	return id, nil
+}
+
+type intKeyCodec[K comparable] struct{}
+
+func (intKeyCodec[K]) EncodeKey(id K) (string, error) {
+	v := reflect.ValueOf(id)
+	if v.CanInt() {
+		return strconv.FormatInt(v.Int(), 10), nil
+	}
+	return strconv.FormatUint(v.Uint(), 10), nil
+}
+
+func (intKeyCodec[K]) DecodeKey(key string) (K, error) {
+	var id K
+	v := reflect.ValueOf(&id).Elem()
+	if v.CanInt() {
+		n, err := strconv.ParseInt(key, 10, v.Type().Bits())
+		if err != nil {
+			return id, err
+		}
+		v.SetInt(n)
+		return id, nil
+	}
+	n, err := strconv.ParseUint(key, 10, v.Type().Bits())
+	if err != nil {
+		return id, err
+	}
+	v.SetUint(n)
+	return id, nil
+}
+
+type textKeyCodec[K comparable] struct{}
+
+func (textKeyCodec[K]) EncodeKey(id K) (string, error) {
+	text, err := any(&id).(encoding.TextMarshaler).MarshalText()
+	return string(text), err
+}
+
+func (textKeyCodec[K]) DecodeKey(key string) (K, error) {
+	var id K
+	err := any(&id).(encoding.TextUnmarshaler).UnmarshalText([]byte(key))
+	return id, err
+}
+
+type jsonKeyCodec[K comparable] struct{}
+
+func (jsonKeyCodec[K]) EncodeKey(id K) (string, error) {
+	key, err := json.Marshal(id)
+	return string(key), err
+}
+
+func (jsonKeyCodec[K]) DecodeKey(key string) (K, error) {
+	var id K
+	err := json.Unmarshal([]byte(key), &id)
+	return id, err
+}
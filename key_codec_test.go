@@ -0,0 +1,167 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+type tenantID string
+
+// compositeID is an example of a composite id made of several fields
+type compositeID struct {
+	Tenant tenantID
+	Seq    uint32
+	Addr   netip.Addr
+}
+
+func TestKeyCodecs(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	testKeyCodec(g, StringKeyCodec[tenantID](), tenantID("acme"), "acme")
+	testKeyCodec(g, IntKeyCodec[int64](), int64(-42), "-42")
+	testKeyCodec(g, IntKeyCodec[uint8](), uint8(255), "255")
+	testKeyCodec(g, TextKeyCodec[netip.Addr](), netip.MustParseAddr("10.0.0.1"), "10.0.0.1")
+	testKeyCodec(g, JSONKeyCodec[compositeID](), compositeID{Tenant: "acme", Seq: 7, Addr: netip.MustParseAddr("::1")},
+		`{"Tenant":"acme","Seq":7,"Addr":"::1"}`)
+
+	_, err := IntKeyCodec[uint8]().DecodeKey("256")
+	g.Expect(err).To(MatchError(`strconv.ParseUint: parsing "256": value out of range`))
+	_, err = IntKeyCodec[int]().DecodeKey("abc")
+	g.Expect(err).To(MatchError(`strconv.ParseInt: parsing "abc": invalid syntax`))
+	_, err = TextKeyCodec[netip.Addr]().DecodeKey("not an ip")
+	g.Expect(err).To(HaveOccurred())
+	_, err = JSONKeyCodec[compositeID]().DecodeKey("{")
+	g.Expect(err).To(HaveOccurred())
+}
+
+// testKeyCodec checks that the codec encodes the id as the expected key, and decodes it back
+func testKeyCodec[K comparable](g *WithT, codec KeyCodec[K], id K, expected string) {
+	key, err := codec.EncodeKey(id)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(key).To(Equal(expected))
+
+	decoded, err := codec.DecodeKey(key)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(decoded).To(Equal(id))
+}
+
+func TestDefaultKeyCodec(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// The keys are the same as the ones of the json maps used by previous versions of the meta files
+	testDefaultKeyCodec(g, "id")
+	testDefaultKeyCodec(g, tenantID("acme"))
+	testDefaultKeyCodec(g, -42)
+	testDefaultKeyCodec(g, uint64(1<<63))
+	testDefaultKeyCodec(g, netip.MustParseAddr("10.0.0.1"))
+
+	codec, err := defaultKeyCodec[compositeID]()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(codec).To(Equal(JSONKeyCodec[compositeID]()))
+	codec2, err := defaultKeyCodec[[2]bool]()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(codec2).To(Equal(JSONKeyCodec[[2]bool]()))
+
+	_, err = defaultKeyCodec[*string]()
+	g.Expect(err).To(MatchError("ids of type *string have no default key codec, configure one with WithKeyCodec"))
+	_, err = defaultKeyCodec[any]()
+	g.Expect(err).To(HaveOccurred())
+	_, err = defaultKeyCodec[struct{ id string }]()
+	g.Expect(err).To(HaveOccurred())
+	_, err = defaultKeyCodec[struct {
+		ID     string
+		Shard  int `json:"-"`
+		Parent *string
+	}]()
+	g.Expect(err).To(HaveOccurred())
+}
+
+// testDefaultKeyCodec checks that the default codec of K encodes the id as the key of a json map, and decodes it back
+func testDefaultKeyCodec[K comparable](g *WithT, id K) {
+	codec, err := defaultKeyCodec[K]()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	b, err := json.Marshal(map[K]int{id: 1})
+	g.Expect(err).ToNot(HaveOccurred())
+	var keys map[string]int
+	g.Expect(json.Unmarshal(b, &keys)).To(Succeed())
+	g.Expect(keys).To(HaveLen(1))
+	for key := range keys {
+		testKeyCodec(g, codec, id, key)
+	}
+}
+
+func TestNewClient_KeyCodec(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	c := NewClient[compositeID](aws.Config{}, testBucketName)
+	g.Expect(c.(*client[compositeID]).idCodec).To(Equal(JSONKeyCodec[compositeID]()))
+
+	c2 := NewClient[*string](aws.Config{}, testBucketName, WithKeyCodec(JSONKeyCodec[*string]()))
+	g.Expect(c2.(*client[*string]).idCodec).To(Equal(JSONKeyCodec[*string]()))
+
+	// The ids that can't be stored in the meta files fail when creating the client
+	g.Expect(func() { NewClient[string](aws.Config{}, testBucketName, WithKeyCodec(IntKeyCodec[int]())) }).To(PanicWith(
+		"s3batchstore: the key codec s3batchstore.intKeyCodec[int] doesn't support ids of type string"))
+	g.Expect(func() { NewClient[*string](aws.Config{}, testBucketName) }).To(PanicWith(
+		"s3batchstore: ids of type *string have no default key codec, configure one with WithKeyCodec"))
+}
+
+func TestClient_LoadIndexesWithCompositeIDs(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[compositeID]{
+		idCodec:  JSONKeyCodec[compositeID](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append(compositeID{Tenant: "acme", Seq: 1}, []byte("first"))).To(Succeed())
+	g.Expect(file.Append(compositeID{Tenant: "acme", Seq: 2, Addr: netip.MustParseAddr("10.0.0.1")}, []byte("second"))).To(Succeed())
+
+	uploaded := map[string][]byte{}
+	s3Mock.EXPECT().PutObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		uploaded[*input.Key] = body
+		return &s3.PutObjectOutput{}, nil
+	}).Times(2)
+	g.Expect(c.UploadFile(ctx, file, true)).To(Succeed())
+
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		return getObjectFromBytes(g, uploaded[*input.Key], input)
+	}).Times(1)
+
+	metaFile, err := c.LoadMetaFile(ctx, file.Name())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(metaFile.Header.KeyType).To(Equal("s3batchstore.compositeID"))
+	g.Expect(metaFile.Entries).To(Equal(file.Indexes()))
+}
+
+func TestDecodeMetaFile_InvalidID(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	metaBody, err := encodeMetaFile(&MetaFile[string]{Entries: map[string]ObjectIndex{"abc": {File: "file"}}}, MetaFileV2, StringKeyCodec[string]())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	metaFile, err := decodeMetaFile(bytes.NewReader(metaBody), IntKeyCodec[int]())
+	g.Expect(err).To(MatchError(`failed to decode the id "abc": strconv.ParseInt: parsing "abc": invalid syntax`))
+	g.Expect(metaFile).To(BeNil())
+}
@@ -0,0 +1,141 @@
+package s3batchstore
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// KeyStrategy decides the s3 key of the files created by NewTempFile.
+// The keys must be unique, which is usually achieved by including the file ID.
+type KeyStrategy interface {
+	FileKey(file FileKeyInput) string
+}
+
+// FileKeyInput holds the information about a new file that a KeyStrategy can use to build its key.
+type FileKeyInput struct {
+	ID        string            // A unique ULID generated for the file
+	CreatedOn time.Time         // When the file was created
+	Tags      map[string]string // The tags of the file
+}
+
+// KeyStrategyFunc is an adapter to use a function as a KeyStrategy.
+type KeyStrategyFunc func(file FileKeyInput) string
+
+func (f KeyStrategyFunc) FileKey(file FileKeyInput) string {
+	return f(file)
+}
+
+// TimeGranularity defines how precise the time component of the keys built by NewKeyStrategy is.
+type TimeGranularity int
+
+const (
+	// GranularityHour formats the creation time as yyyy/mm/dd/hh. This is the default.
+	GranularityHour TimeGranularity = iota
+	// GranularityDay formats the creation time as yyyy/mm/dd.
+	GranularityDay
+	// GranularityMonth formats the creation time as yyyy/mm.
+	GranularityMonth
+	// GranularityYear formats the creation time as yyyy.
+	GranularityYear
+	// GranularityNone doesn't include the creation time in the key.
+	GranularityNone
+)
+
+// format returns the time formatted with this granularity, in UTC timezone.
+func (g TimeGranularity) format(t time.Time) string {
+	switch g {
+	case GranularityDay:
+		return t.UTC().Format("2006/01/02")
+	case GranularityMonth:
+		return t.UTC().Format("2006/01")
+	case GranularityYear:
+		return t.UTC().Format("2006")
+	case GranularityNone:
+		return ""
+	default:
+		return timeToFilePath(t)
+	}
+}
+
+// missingPartitionValue is used in the key of the files that don't have one of the partition tags
+const missingPartitionValue = "_"
+
+// KeyStrategyOption allows to customize the KeyStrategy created with NewKeyStrategy.
+type KeyStrategyOption func(*keyStrategy)
+
+// WithKeyPrefix sets the prefix of the keys. Defaults to "v1". An empty prefix removes it.
+func WithKeyPrefix(prefix string) KeyStrategyOption {
+	return func(s *keyStrategy) {
+		s.prefix = prefix
+	}
+}
+
+// WithTimeGranularity sets how precise the time component of the keys is. Defaults to GranularityHour.
+func WithTimeGranularity(granularity TimeGranularity) KeyStrategyOption {
+	return func(s *keyStrategy) {
+		s.granularity = granularity
+	}
+}
+
+// WithTagPartitions adds a tag=value component to the keys for each of the given tags, in the same order, which
+// allows to lay out the files per tenant or per retention class, for example. Files without one of the tags use
+// "_" as its value.
+func WithTagPartitions(tags ...string) KeyStrategyOption {
+	return func(s *keyStrategy) {
+		s.partitionTags = append(s.partitionTags, tags...)
+	}
+}
+
+// WithHashedPrefix adds a component of length hexadecimal characters, derived from the file ID, after the prefix
+// and the tag partitions. This spreads the files over many prefixes, to scale beyond the s3 request rate limits
+// of a single prefix. length is capped at 8.
+func WithHashedPrefix(length int) KeyStrategyOption {
+	return func(s *keyStrategy) {
+		s.hashLength = min(length, 8)
+	}
+}
+
+// keyStrategy is the KeyStrategy created by NewKeyStrategy.
+type keyStrategy struct {
+	prefix        string
+	partitionTags []string
+	hashLength    int
+	granularity   TimeGranularity
+}
+
+// NewKeyStrategy creates a KeyStrategy that builds keys as prefix/tag partitions/hash/time/ID, skipping the
+// components that are not configured. Without options, the keys are v1/yyyy/mm/dd/hh/ID, which is the default
+// layout of NewTempFile.
+func NewKeyStrategy(opts ...KeyStrategyOption) KeyStrategy {
+	s := &keyStrategy{prefix: version}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *keyStrategy) FileKey(file FileKeyInput) string {
+	components := []string{strings.Trim(s.prefix, "/")}
+	for _, tag := range s.partitionTags {
+		value, ok := file.Tags[tag]
+		if !ok || value == "" {
+			value = missingPartitionValue
+		}
+		components = append(components, url.PathEscape(tag)+"="+url.PathEscape(value))
+	}
+	if s.hashLength > 0 {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(file.ID))
+		components = append(components, hex.EncodeToString(hash.Sum(nil))[:s.hashLength])
+	}
+	components = append(components, s.granularity.format(file.CreatedOn), file.ID)
+	// path.Join skips the empty components
+	return path.Join(components...)
+}
+
+// defaultKeyStrategy is used by the files that don't set a KeyStrategy
+var defaultKeyStrategy = NewKeyStrategy()
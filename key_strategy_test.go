@@ -0,0 +1,121 @@
+package s3batchstore
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestKeyStrategy(t *testing.T) {
+	createdOn := time.Date(2021, 10, 8, 2, 10, 14, 33, time.UTC)
+	input := FileKeyInput{
+		ID:        "01HZ0000000000000000000000",
+		CreatedOn: createdOn,
+		Tags:      map[string]string{"tenant": "acme", "retention-days": "14"},
+	}
+
+	tests := []struct {
+		name     string
+		opts     []KeyStrategyOption
+		expected string
+	}{
+		{
+			name:     "default",
+			expected: "v1/2021/10/08/02/01HZ0000000000000000000000",
+		},
+		{
+			name:     "prefix and granularity",
+			opts:     []KeyStrategyOption{WithKeyPrefix("/data/events/"), WithTimeGranularity(GranularityDay)},
+			expected: "data/events/2021/10/08/01HZ0000000000000000000000",
+		},
+		{
+			name:     "no prefix nor time",
+			opts:     []KeyStrategyOption{WithKeyPrefix(""), WithTimeGranularity(GranularityNone)},
+			expected: "01HZ0000000000000000000000",
+		},
+		{
+			name:     "month",
+			opts:     []KeyStrategyOption{WithTimeGranularity(GranularityMonth)},
+			expected: "v1/2021/10/01HZ0000000000000000000000",
+		},
+		{
+			name:     "year",
+			opts:     []KeyStrategyOption{WithTimeGranularity(GranularityYear)},
+			expected: "v1/2021/01HZ0000000000000000000000",
+		},
+		{
+			name:     "tag partitions",
+			opts:     []KeyStrategyOption{WithTagPartitions("tenant", "retention-days"), WithTagPartitions("missing")},
+			expected: "v1/tenant=acme/retention-days=14/missing=_/2021/10/08/02/01HZ0000000000000000000000",
+		},
+		{
+			name:     "hashed prefix",
+			opts:     []KeyStrategyOption{WithTagPartitions("tenant"), WithHashedPrefix(4)},
+			expected: "v1/tenant=acme/1d37/2021/10/08/02/01HZ0000000000000000000000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			g.Expect(NewKeyStrategy(tt.opts...).FileKey(input)).To(Equal(tt.expected))
+		})
+	}
+}
+
+func TestKeyStrategy_EscapesTags(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	strategy := NewKeyStrategy(WithTagPartitions("tenant"), WithTimeGranularity(GranularityNone))
+	key := strategy.FileKey(FileKeyInput{ID: "id", Tags: map[string]string{"tenant": "a/b c"}})
+	g.Expect(key).To(Equal("v1/tenant=a%2Fb%20c/id"))
+}
+
+func TestKeyStrategy_HashedPrefixSpreadsFiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	strategy := NewKeyStrategy(WithHashedPrefix(2), WithTimeGranularity(GranularityNone))
+	prefixes := map[string]bool{}
+	for range 100 {
+		file, err := NewTempFile[string](nil, WithKeyStrategy(strategy))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(file.Close()).To(Succeed())
+		g.Expect(file.Name()).To(MatchRegexp(`^v1/[0-9a-f]{2}/[0-9A-Z]{26}$`))
+		prefixes[strings.Split(file.Name(), "/")[1]] = true
+	}
+	g.Expect(len(prefixes)).To(BeNumerically(">", 10))
+}
+
+func TestNewTempFile_KeyStrategy(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// By default, files are laid out as v1/yyyy/mm/dd/hh/ULID
+	file, err := NewTempFile[string](testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Name()).To(MatchRegexp(`^v1/\d{4}/\d{2}/\d{2}/\d{2}/[0-9A-Z]{26}$`))
+
+	var input FileKeyInput
+	strategy := KeyStrategyFunc(func(file FileKeyInput) string {
+		input = file
+		return "custom/" + file.Tags["retention-days"] + "/" + file.ID
+	})
+	c := client[string]{
+		idCodec:       StringKeyCodec[string](),
+		clientOptions: clientOptions{tempFileOpts: []TempFileOption{WithKeyStrategy(strategy)}},
+	}
+	file2, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file2.Close() }()
+	g.Expect(file2.Name()).To(Equal("custom/14/" + input.ID))
+	g.Expect(file2.MetaFileKey()).To(Equal("custom/14/" + input.ID + metaFileSuffix))
+	g.Expect(input.Tags).To(Equal(testTags))
+	g.Expect(input.CreatedOn).To(BeTemporally("~", time.Now(), time.Second))
+	g.Expect(regexp.MustCompile(`^[0-9A-Z]{26}$`).MatchString(input.ID)).To(BeTrue())
+
+	// Empty keys are rejected
+	_, err = NewTempFile[string](testTags, WithKeyStrategy(KeyStrategyFunc(func(FileKeyInput) string { return "" })))
+	g.Expect(err).To(MatchError("the key strategy returned an empty file key"))
+}
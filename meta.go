@@ -0,0 +1,317 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/klauspost/compress/zstd"
+)
+
+// metaFileSuffix is appended to the data file key to build the key of its meta file
+const metaFileSuffix = ".meta.json.zst"
+
+// The versions of the meta file format
+const (
+	// MetaFileV1 is the original format, a bare json map of the indexes by object id, without a header
+	MetaFileV1 = 1
+	// MetaFileV2 wraps the indexes in an envelope with a header describing the data file
+	MetaFileV2 = 2
+
+	// currentMetaFileVersion is the version written by UploadFile by default
+	currentMetaFileVersion = MetaFileV2
+)
+
+// MetaFile holds the contents of a meta file: a header that describes the data file, and the indexes of its objects.
+type MetaFile[K comparable] struct {
+	Header  MetaFileHeader
+	Entries map[K]ObjectIndex
+	// Versions holds the older versions of the objects appended more than once with DuplicateKeepAll, from the
+	// oldest to the newest, the latest one being in Entries. They are not stored in MetaFileV1 meta files.
+	Versions map[K][]ObjectIndex
+}
+
+// encodedMetaFile is the json representation of a MetaFile in the MetaFileV2 format, where the ids are encoded
+// with the KeyCodec of the client.
+type encodedMetaFile struct {
+	Header   MetaFileHeader           `json:"header"`
+	Entries  map[string]ObjectIndex   `json:"entries"`
+	Versions map[string][]ObjectIndex `json:"versions,omitempty"`
+}
+
+// MetaFileHeader describes the data file that a meta file belongs to.
+// Meta files in the MetaFileV1 format only have the Version and the Count.
+type MetaFileHeader struct {
+	Version           int                     `json:"version"`
+	CreatedOn         time.Time               `json:"created_on,omitzero"`
+	Tags              map[string]string       `json:"tags,omitempty"`
+	Count             int                     `json:"count"`              // The number of objects in the file
+	Size              uint64                  `json:"size"`               // The size of the data file in bytes
+	KeyType           string                  `json:"key_type,omitempty"` // The go type of the object ids
+	ChecksumAlgorithm types.ChecksumAlgorithm `json:"checksum_algorithm,omitempty"`
+	Checksum          string                  `json:"checksum,omitempty"` // The whole data file checksum, if computed
+}
+
+// WithMetaFileVersion sets the format of the meta file written by UploadFile, which defaults to MetaFileV2.
+// MetaFileV1 can be used while there are still readers running a version that only understands that format.
+func WithMetaFileVersion(version int) UploadOption {
+	return func(o *uploadOptions) {
+		o.metaFileVersion = version
+	}
+}
+
+func (c *client[K]) LoadIndexes(ctx context.Context, fileKey string) (map[K]ObjectIndex, error) {
+	metaFile, err := c.LoadMetaFile(ctx, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return metaFile.Entries, nil
+}
+
+func (c *client[K]) LoadMetaFile(ctx context.Context, fileKey string) (*MetaFile[K], error) {
+	metafileKey := metaFileKey(fileKey)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.s3Bucket),
+		Key:    aws.String(metafileKey),
+	}
+	c.sseCustomerKey.applyToGet(input)
+	result, err := c.s3Client.GetObject(ctx, input)
+	if err != nil {
+		if isMissingObject(err) {
+			// The file may have been uploaded with WithFooterIndex, and without a meta file
+			if metaFile, footerErr := c.ReadFooter(ctx, fileKey); footerErr == nil {
+				return metaFile, nil
+			}
+		}
+		return nil, fmt.Errorf("failed to download meta file %s/%s: %w", c.s3Bucket, metafileKey, err)
+	}
+	defer func() { _ = result.Body.Close() }()
+
+	metaFile, err := decodeMetaFile(result.Body, c.idCodec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta file %s/%s: %w", c.s3Bucket, metafileKey, err)
+	}
+	return metaFile, nil
+}
+
+// isMissingObject returns whether the error may have been caused by downloading an object that doesn't exist.
+// Without the s3:ListBucket permission, s3 returns AccessDenied (403) instead of NoSuchKey (404) for those.
+func isMissingObject(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == http.StatusNotFound || status == http.StatusForbidden
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "AccessDenied")
+}
+
+func (c *client[K]) FetchByID(ctx context.Context, fileKey string, id K) ([]byte, error) {
+	ind, err := c.indexByID(ctx, fileKey, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Fetch(ctx, ind)
+}
+
+func (c *client[K]) FetchWithMetadata(ctx context.Context, fileKey string, id K) ([]byte, ObjectAttributes, error) {
+	ind, err := c.indexByID(ctx, fileKey, id)
+	if err != nil {
+		return nil, ObjectAttributes{}, err
+	}
+
+	payload, err := c.Fetch(ctx, ind)
+	if err != nil {
+		return nil, ObjectAttributes{}, err
+	}
+	if ind.Attributes == nil {
+		return payload, ObjectAttributes{}, nil
+	}
+	return payload, *ind.Attributes, nil
+}
+
+// indexByID resolves the index of the object identified by id through the meta file of the given file.
+func (c *client[K]) indexByID(ctx context.Context, fileKey string, id K) (ObjectIndex, error) {
+	indexes, err := c.cachedIndexes(ctx, fileKey)
+	if err != nil {
+		return ObjectIndex{}, err
+	}
+
+	ind, ok := indexes[id]
+	if !ok {
+		return ObjectIndex{}, fmt.Errorf("%w: id %v in file %s/%s", ErrObjectNotFound, id, c.s3Bucket, fileKey)
+	}
+	return ind, nil
+}
+
+// cachedIndexes returns the indexes of the given file from the index cache, loading its meta file on a cache miss.
+// The returned map is shared, and must not be modified.
+func (c *client[K]) cachedIndexes(ctx context.Context, fileKey string) (map[K]ObjectIndex, error) {
+	if indexes, ok := c.indexCache.Get(fileKey); ok {
+		return indexes, nil
+	}
+
+	indexes, err := c.LoadIndexes(ctx, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	c.indexCache.Add(fileKey, indexes)
+	return indexes, nil
+}
+
+// metaFileKey returns the key of the meta file that belongs to the given data file.
+func metaFileKey(fileKey string) string {
+	return fileKey + metaFileSuffix
+}
+
+// newMetaFile builds the meta file of the given file, whose data file was uploaded with the given checksum.
+func newMetaFile[K comparable](file *TempFile[K], algorithm types.ChecksumAlgorithm, checksum string) *MetaFile[K] {
+	return &MetaFile[K]{
+		Header: MetaFileHeader{
+			Version:           currentMetaFileVersion,
+			CreatedOn:         file.createdOn.UTC(),
+			Tags:              file.tags,
+			Count:             len(file.indexes),
+			Size:              file.offset,
+			KeyType:           reflect.TypeFor[K]().String(),
+			ChecksumAlgorithm: algorithm,
+			Checksum:          checksum,
+		},
+		Entries:  file.indexes,
+		Versions: file.versions,
+	}
+}
+
+// encodeMetaFile serializes the meta file to json in the given format version, with the ids encoded by codec,
+// and compresses it with zstd.
+func encodeMetaFile[K comparable](metaFile *MetaFile[K], version int, codec KeyCodec[K]) ([]byte, error) {
+	entries := make(map[string]ObjectIndex, len(metaFile.Entries))
+	for id, index := range metaFile.Entries {
+		key, err := codec.EncodeKey(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the id %v: %w", id, err)
+		}
+		entries[key] = index
+	}
+
+	var body any
+	switch version {
+	case MetaFileV1:
+		body = entries
+	case MetaFileV2:
+		header := metaFile.Header
+		header.Version = version
+		encoded := &encodedMetaFile{Header: header, Entries: entries}
+		for id, versions := range metaFile.Versions {
+			key, err := codec.EncodeKey(id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode the id %v: %w", id, err)
+			}
+			if encoded.Versions == nil {
+				encoded.Versions = map[string][]ObjectIndex{}
+			}
+			encoded.Versions[key] = versions
+		}
+		body = encoded
+	default:
+		return nil, fmt.Errorf("unsupported meta file version %d", version)
+	}
+
+	metafileBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal meta body: %w", err)
+	}
+
+	// Compress the metafile body with zstd
+	var compressedBuf bytes.Buffer
+	zstdWriter, err := zstd.NewWriter(&compressedBuf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+	}
+	_, err = zstdWriter.Write(metafileBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to zstd writer: %w", err)
+	}
+	err = zstdWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close zstd writer: %w", err)
+	}
+	return compressedBuf.Bytes(), nil
+}
+
+// decodeMetaFile is the inverse of encodeMetaFile, it decompresses and parses the meta file contents in any of the
+// supported versions.
+func decodeMetaFile[K comparable](r io.Reader, codec KeyCodec[K]) (*MetaFile[K], error) {
+	zstdReader, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zstdReader.Close()
+
+	metafileBody, err := io.ReadAll(zstdReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal meta body: %w", err)
+	}
+
+	// The v1 files are a bare map without a header. A v1 map could have an object with the id "header", but its
+	// index doesn't have a version, so it can't be mistaken for the header of a newer version.
+	var probe struct {
+		Header struct {
+			Version int `json:"version"`
+		} `json:"header"`
+	}
+	if err = json.Unmarshal(metafileBody, &probe); err != nil {
+		probe.Header.Version = MetaFileV1 // Leave it to the v1 decoding to report the error
+	}
+
+	var metaFile encodedMetaFile
+	switch version := probe.Header.Version; {
+	case version < MetaFileV2:
+		if err = json.Unmarshal(metafileBody, &metaFile.Entries); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal meta body: %w", err)
+		}
+		metaFile.Header = MetaFileHeader{Version: MetaFileV1, Count: len(metaFile.Entries)}
+	case version == MetaFileV2:
+		if err = json.Unmarshal(metafileBody, &metaFile); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal meta body: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported meta file version %d", version)
+	}
+
+	entries := make(map[K]ObjectIndex, len(metaFile.Entries))
+	for key, index := range metaFile.Entries {
+		id, err := codec.DecodeKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the id %q: %w", key, err)
+		}
+		entries[id] = index
+	}
+	var versions map[K][]ObjectIndex
+	for key, indexes := range metaFile.Versions {
+		id, err := codec.DecodeKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the id %q: %w", key, err)
+		}
+		if versions == nil {
+			versions = make(map[K][]ObjectIndex, len(metaFile.Versions))
+		}
+		versions[id] = indexes
+	}
+	return &MetaFile[K]{Header: metaFile.Header, Entries: entries, Versions: versions}, nil
+}
@@ -0,0 +1,453 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestClient_LoadIndexes(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	for _, obj := range []*TestObject{{ID: "1", Value: "first"}, {ID: "2", Value: "second"}} {
+		compressed, err := marshalAndCompress(obj)
+		g.Expect(err).ToNot(HaveOccurred())
+		_, err = file.AppendAndReturnIndex(obj.ID, compressed)
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	// Upload the file, keeping the meta file contents in order to serve them later
+	uploaded := map[string][]byte{}
+	s3Mock.EXPECT().PutObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		uploaded[*input.Key] = body
+		return &s3.PutObjectOutput{}, nil
+	}).Times(2)
+	g.Expect(c.UploadFile(ctx, file, true)).To(Succeed())
+
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		g.Expect(*input.Bucket).To(Equal(testBucketName))
+		g.Expect(*input.Key).To(Equal(file.MetaFileKey()))
+		g.Expect(input.Range).To(BeNil())
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(uploaded[*input.Key]))}, nil
+	}).Times(1)
+
+	indexes, err := c.LoadIndexes(ctx, file.Name())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(indexes).To(Equal(file.Indexes()))
+}
+
+func TestClient_LoadIndexesError(t *testing.T) {
+	tests := []struct {
+		name   string
+		output *s3.GetObjectOutput
+		err    error
+		errMsg interface{}
+	}{
+		{
+			name:   "s3 download error",
+			err:    errors.New("error connecting to s3"),
+			errMsg: "failed to download meta file test-bucket/1234.meta.json.zst: error connecting to s3",
+		},
+		{
+			name:   "invalid meta file contents",
+			output: &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader([]byte("not zstd")))},
+			errMsg: ContainSubstring("failed to read meta file test-bucket/1234.meta.json.zst: failed to unmarshal meta body: "),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).Return(test.output, test.err).Times(1)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			indexes, err := c.LoadIndexes(ctx, "1234")
+			g.Expect(err).To(MatchError(test.errMsg))
+			g.Expect(indexes).To(BeNil())
+		})
+	}
+}
+
+func TestClient_FetchByID(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	const fileKey = "v1/2024/01/01/00/file"
+	contents := []byte("aaaaaaaaaabbbbbbbbbb")
+	metaBody, err := encodeMetaFile(&MetaFile[string]{Entries: map[string]ObjectIndex{
+		"a": {File: fileKey, Offset: 0, Length: 10},
+		"b": {File: fileKey, Offset: 10, Length: 10},
+	}}, MetaFileV2, StringKeyCodec[string]())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	// The meta file is downloaded only once, and then served from the cache
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		if *input.Key == metaFileKey(fileKey) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(metaBody))}, nil
+		}
+		g.Expect(*input.Key).To(Equal(fileKey))
+		return getObjectFromBytes(g, contents, input)
+	}).Times(3)
+
+	c := &client[string]{
+		idCodec:    StringKeyCodec[string](),
+		s3Bucket:   testBucketName,
+		s3Client:   s3Mock,
+		indexCache: newLRUCache[string, map[string]ObjectIndex](1),
+	}
+
+	b, err := c.FetchByID(ctx, fileKey, "b")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(b)).To(Equal("bbbbbbbbbb"))
+
+	b, err = c.FetchByID(ctx, fileKey, "a")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(b)).To(Equal("aaaaaaaaaa"))
+
+	b, err = c.FetchByID(ctx, fileKey, "c")
+	g.Expect(err).To(MatchError(ErrObjectNotFound))
+	g.Expect(err).To(MatchError("object not found: id c in file test-bucket/" + fileKey))
+	g.Expect(b).To(BeNil())
+}
+
+func TestClient_FetchByIDWithoutCache(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	const fileKey = "file"
+	metaBody, err := encodeMetaFile(&MetaFile[string]{Entries: map[string]ObjectIndex{
+		"a": {File: fileKey, Offset: 0, Length: 10},
+	}}, MetaFileV2, StringKeyCodec[string]())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	// Without a cache, the meta file is downloaded on every call
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		g.Expect(*input.Key).To(Equal(metaFileKey(fileKey)))
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(metaBody))}, nil
+	}).Times(2)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).Return(nil, errors.New("error connecting to s3")).Times(1)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	_, err = c.FetchByID(ctx, fileKey, "missing")
+	g.Expect(err).To(MatchError(ErrObjectNotFound))
+
+	_, err = c.FetchByID(ctx, fileKey, "a")
+	g.Expect(err).To(MatchError("failed to download object from file test-bucket/file bytes=0-9: error connecting to s3"))
+}
+
+func TestClient_FetchWithMetadata(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	const fileKey = "file"
+	contents := []byte("aaaaaaaaaabbbbbbbbbb")
+	attributes := ObjectAttributes{ContentType: "text/plain", Metadata: map[string]string{"source": "test"}}
+	metaBody, err := encodeMetaFile(&MetaFile[string]{Entries: map[string]ObjectIndex{
+		"a": {File: fileKey, Offset: 0, Length: 10, Attributes: &attributes},
+		"b": {File: fileKey, Offset: 10, Length: 10},
+	}}, MetaFileV2, StringKeyCodec[string]())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		if *input.Key == metaFileKey(fileKey) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(metaBody))}, nil
+		}
+		return getObjectFromBytes(g, contents, input)
+	}).Times(3)
+
+	c := &client[string]{
+		idCodec:    StringKeyCodec[string](),
+		s3Bucket:   testBucketName,
+		s3Client:   s3Mock,
+		indexCache: newLRUCache[string, map[string]ObjectIndex](1),
+	}
+
+	payload, attrs, err := c.FetchWithMetadata(ctx, fileKey, "a")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(payload)).To(Equal("aaaaaaaaaa"))
+	g.Expect(attrs).To(Equal(attributes))
+
+	// Objects without attributes return empty ones
+	payload, attrs, err = c.FetchWithMetadata(ctx, fileKey, "b")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(payload)).To(Equal("bbbbbbbbbb"))
+	g.Expect(attrs).To(BeZero())
+
+	_, _, err = c.FetchWithMetadata(ctx, fileKey, "c")
+	g.Expect(err).To(MatchError(ErrObjectNotFound))
+}
+
+func TestMetaFileVersions(t *testing.T) {
+	createdOn := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	metaFile := &MetaFile[string]{
+		Header: MetaFileHeader{
+			Version:           MetaFileV2,
+			CreatedOn:         createdOn,
+			Tags:              map[string]string{"retention-days": "14"},
+			Count:             2,
+			Size:              20,
+			KeyType:           "string",
+			ChecksumAlgorithm: types.ChecksumAlgorithmCrc32c,
+			Checksum:          "4waSgw==",
+		},
+		Entries: map[string]ObjectIndex{
+			"a":      {File: "file", Offset: 0, Length: 10},
+			"header": {File: "file", Offset: 10, Length: 10},
+		},
+		Versions: map[string][]ObjectIndex{
+			"a": {{File: "file", Offset: 20, Length: 5}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		contents []byte
+		version  int
+		expected *MetaFile[string]
+		err      string
+	}{
+		{
+			name:     "v2",
+			version:  MetaFileV2,
+			expected: metaFile,
+		},
+		{
+			name:    "v1",
+			version: MetaFileV1,
+			// The v1 files only know the latest indexes, even if one of them has the id "header"
+			expected: &MetaFile[string]{Header: MetaFileHeader{Version: MetaFileV1, Count: 2}, Entries: metaFile.Entries},
+		},
+		{
+			name:     "v1 written by older versions",
+			contents: []byte(`{"a":{"file":"file","offset":0,"length":10}}`),
+			expected: &MetaFile[string]{
+				Header:  MetaFileHeader{Version: MetaFileV1, Count: 1},
+				Entries: map[string]ObjectIndex{"a": {File: "file", Offset: 0, Length: 10}},
+			},
+		},
+		{
+			name:     "v2 without entries",
+			contents: []byte(`{"header":{"version":2,"count":0,"size":0}}`),
+			expected: &MetaFile[string]{Header: MetaFileHeader{Version: MetaFileV2}, Entries: map[string]ObjectIndex{}},
+		},
+		{
+			name:     "unknown version",
+			contents: []byte(`{"header":{"version":3},"entries":{}}`),
+			err:      "unsupported meta file version 3",
+		},
+		{
+			name:     "invalid v2",
+			contents: []byte(`{"header":{"version":2},"entries":[]}`),
+			err:      "failed to unmarshal meta body: json: cannot unmarshal array into Go struct field encodedMetaFile.entries of type map[string]s3batchstore.ObjectIndex",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			var metaBody []byte
+			var err error
+			if test.contents != nil {
+				zstdWriter, err := zstd.NewWriter(nil)
+				g.Expect(err).ToNot(HaveOccurred())
+				metaBody = zstdWriter.EncodeAll(test.contents, nil)
+			} else {
+				metaBody, err = encodeMetaFile(metaFile, test.version, StringKeyCodec[string]())
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			decoded, err := decodeMetaFile(bytes.NewReader(metaBody), StringKeyCodec[string]())
+			if test.err == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(decoded).To(Equal(test.expected))
+			} else {
+				g.Expect(err).To(MatchError(test.err))
+				g.Expect(decoded).To(BeNil())
+			}
+		})
+	}
+
+	_, err := encodeMetaFile(metaFile, 3, StringKeyCodec[string]())
+	NewGomegaWithT(t).Expect(err).To(MatchError("unsupported meta file version 3"))
+}
+
+func TestClient_LoadMetaFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[int]{
+		idCodec:       IntKeyCodec[int](),
+		s3Bucket:      testBucketName,
+		s3Client:      s3Mock,
+		clientOptions: clientOptions{uploadOpts: []UploadOption{WithChecksumAlgorithm(types.ChecksumAlgorithmCrc32c)}},
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append(1, []byte("first"))).To(Succeed())
+	g.Expect(file.Append(2, []byte("second"))).To(Succeed())
+
+	uploaded := map[string][]byte{}
+	s3Mock.EXPECT().PutObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		uploaded[*input.Key] = body
+		return &s3.PutObjectOutput{}, nil
+	}).Times(2)
+	g.Expect(c.UploadFile(ctx, file, true)).To(Succeed())
+
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		g.Expect(*input.Key).To(Equal(file.MetaFileKey()))
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(uploaded[*input.Key]))}, nil
+	}).Times(1)
+
+	metaFile, err := c.LoadMetaFile(ctx, file.Name())
+	g.Expect(err).ToNot(HaveOccurred())
+	checksum, err := computeChecksum(types.ChecksumAlgorithmCrc32c, bytes.NewReader(uploaded[file.Name()]))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(metaFile.Header).To(Equal(MetaFileHeader{
+		Version:           MetaFileV2,
+		CreatedOn:         file.createdOn.UTC(),
+		Tags:              testTags,
+		Count:             2,
+		Size:              11,
+		KeyType:           "int",
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32c,
+		Checksum:          checksum,
+	}))
+	g.Expect(metaFile.Entries).To(Equal(file.Indexes()))
+}
+
+func TestClient_UploadFileMetaFileVersion(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("first"))).To(Succeed())
+
+	// An unsupported version fails before uploading anything
+	err = c.UploadFile(ctx, file, true, WithMetaFileVersion(3))
+	g.Expect(err).To(MatchError("unsupported meta file version 3"))
+
+	// The v1 format is the bare map of indexes
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.fileName)).Return(&s3.PutObjectOutput{}, nil)
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.MetaFileKey())).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		zstdReader, err := zstd.NewReader(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		defer zstdReader.Close()
+		body, err := io.ReadAll(zstdReader)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(body).To(MatchJSON(`{"1":{"file":"` + file.fileName + `","offset":0,"length":5}}`))
+		return &s3.PutObjectOutput{}, nil
+	})
+	g.Expect(c.UploadFile(ctx, file, true, WithMetaFileVersion(MetaFileV1))).To(Succeed())
+}
+
+func TestClient_LoadMetaFileWithVersions(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	file, err := c.NewTempFile(testTags, WithDuplicatePolicy(DuplicateKeepAll))
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("first"))).To(Succeed())
+	g.Expect(file.Append("1", []byte("second"))).To(Succeed())
+	g.Expect(file.Append("2", []byte("third"))).To(Succeed())
+
+	uploaded := map[string][]byte{}
+	s3Mock.EXPECT().PutObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		uploaded[*input.Key] = body
+		return &s3.PutObjectOutput{}, nil
+	}).Times(2)
+	g.Expect(c.UploadFile(ctx, file, true, WithFooterIndex())).To(Succeed())
+
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		return getObjectFromBytes(g, uploaded[*input.Key], input)
+	}).Times(2)
+
+	// The older versions are in the meta file and in the footer
+	metaFile, err := c.LoadMetaFile(ctx, file.Name())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(metaFile.Entries).To(Equal(file.Indexes()))
+	g.Expect(metaFile.Versions).To(Equal(map[string][]ObjectIndex{"1": file.Versions("1")[:1]}))
+
+	footer, err := c.ReadFooter(ctx, file.Name())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(footer.Versions).To(Equal(metaFile.Versions))
+}
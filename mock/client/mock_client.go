@@ -11,6 +11,7 @@ package mocks3batchstore
 
 import (
 	context "context"
+	io "io"
 	reflect "reflect"
 
 	s3 "github.com/aws/aws-sdk-go-v2/service/s3"
@@ -22,6 +23,7 @@ import (
 type MockClient[K comparable] struct {
 	ctrl     *gomock.Controller
 	recorder *MockClientMockRecorder[K]
+	isgomock struct{}
 }
 
 // MockClientMockRecorder is the mock recorder for MockClient.
@@ -70,39 +72,184 @@ func (mr *MockClientMockRecorder[K]) Fetch(ctx, ind any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Fetch", reflect.TypeOf((*MockClient[K])(nil).Fetch), ctx, ind)
 }
 
+// FetchByID mocks base method.
+func (m *MockClient[K]) FetchByID(ctx context.Context, fileKey string, id K) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchByID", ctx, fileKey, id)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchByID indicates an expected call of FetchByID.
+func (mr *MockClientMockRecorder[K]) FetchByID(ctx, fileKey, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchByID", reflect.TypeOf((*MockClient[K])(nil).FetchByID), ctx, fileKey, id)
+}
+
+// FetchMany mocks base method.
+func (m *MockClient[K]) FetchMany(ctx context.Context, inds []s3batchstore.ObjectIndex) ([][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchMany", ctx, inds)
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchMany indicates an expected call of FetchMany.
+func (mr *MockClientMockRecorder[K]) FetchMany(ctx, inds any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchMany", reflect.TypeOf((*MockClient[K])(nil).FetchMany), ctx, inds)
+}
+
+// FetchReader mocks base method.
+func (m *MockClient[K]) FetchReader(ctx context.Context, ind s3batchstore.ObjectIndex) (io.ReadCloser, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchReader", ctx, ind)
+	ret0, _ := ret[0].(io.ReadCloser)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchReader indicates an expected call of FetchReader.
+func (mr *MockClientMockRecorder[K]) FetchReader(ctx, ind any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchReader", reflect.TypeOf((*MockClient[K])(nil).FetchReader), ctx, ind)
+}
+
+// FetchWithMetadata mocks base method.
+func (m *MockClient[K]) FetchWithMetadata(ctx context.Context, fileKey string, id K) ([]byte, s3batchstore.ObjectAttributes, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchWithMetadata", ctx, fileKey, id)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(s3batchstore.ObjectAttributes)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// FetchWithMetadata indicates an expected call of FetchWithMetadata.
+func (mr *MockClientMockRecorder[K]) FetchWithMetadata(ctx, fileKey, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchWithMetadata", reflect.TypeOf((*MockClient[K])(nil).FetchWithMetadata), ctx, fileKey, id)
+}
+
+// LoadIndexes mocks base method.
+func (m *MockClient[K]) LoadIndexes(ctx context.Context, fileKey string) (map[K]s3batchstore.ObjectIndex, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadIndexes", ctx, fileKey)
+	ret0, _ := ret[0].(map[K]s3batchstore.ObjectIndex)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadIndexes indicates an expected call of LoadIndexes.
+func (mr *MockClientMockRecorder[K]) LoadIndexes(ctx, fileKey any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadIndexes", reflect.TypeOf((*MockClient[K])(nil).LoadIndexes), ctx, fileKey)
+}
+
+// LoadMetaFile mocks base method.
+func (m *MockClient[K]) LoadMetaFile(ctx context.Context, fileKey string) (*s3batchstore.MetaFile[K], error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadMetaFile", ctx, fileKey)
+	ret0, _ := ret[0].(*s3batchstore.MetaFile[K])
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadMetaFile indicates an expected call of LoadMetaFile.
+func (mr *MockClientMockRecorder[K]) LoadMetaFile(ctx, fileKey any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadMetaFile", reflect.TypeOf((*MockClient[K])(nil).LoadMetaFile), ctx, fileKey)
+}
+
 // NewTempFile mocks base method.
-func (m *MockClient[K]) NewTempFile(tags map[string]string) (*s3batchstore.TempFile[K], error) {
+func (m *MockClient[K]) NewTempFile(tags map[string]string, opts ...s3batchstore.TempFileOption) (*s3batchstore.TempFile[K], error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "NewTempFile", tags)
+	varargs := []any{tags}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "NewTempFile", varargs...)
 	ret0, _ := ret[0].(*s3batchstore.TempFile[K])
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // NewTempFile indicates an expected call of NewTempFile.
-func (mr *MockClientMockRecorder[K]) NewTempFile(tags any) *gomock.Call {
+func (mr *MockClientMockRecorder[K]) NewTempFile(tags any, opts ...any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewTempFile", reflect.TypeOf((*MockClient[K])(nil).NewTempFile), tags)
+	varargs := append([]any{tags}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewTempFile", reflect.TypeOf((*MockClient[K])(nil).NewTempFile), varargs...)
+}
+
+// ReadFooter mocks base method.
+func (m *MockClient[K]) ReadFooter(ctx context.Context, fileKey string) (*s3batchstore.MetaFile[K], error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadFooter", ctx, fileKey)
+	ret0, _ := ret[0].(*s3batchstore.MetaFile[K])
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadFooter indicates an expected call of ReadFooter.
+func (mr *MockClientMockRecorder[K]) ReadFooter(ctx, fileKey any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadFooter", reflect.TypeOf((*MockClient[K])(nil).ReadFooter), ctx, fileKey)
+}
+
+// Scan mocks base method.
+func (m *MockClient[K]) Scan(ctx context.Context, fileKey string, fn func(K, []byte) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Scan", ctx, fileKey, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Scan indicates an expected call of Scan.
+func (mr *MockClientMockRecorder[K]) Scan(ctx, fileKey, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Scan", reflect.TypeOf((*MockClient[K])(nil).Scan), ctx, fileKey, fn)
 }
 
 // UploadFile mocks base method.
-func (m *MockClient[K]) UploadFile(ctx context.Context, file *s3batchstore.TempFile[K], withMetaFile bool) error {
+func (m *MockClient[K]) UploadFile(ctx context.Context, file *s3batchstore.TempFile[K], withMetaFile bool, opts ...s3batchstore.UploadOption) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UploadFile", ctx, file, withMetaFile)
+	varargs := []any{ctx, file, withMetaFile}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "UploadFile", varargs...)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UploadFile indicates an expected call of UploadFile.
-func (mr *MockClientMockRecorder[K]) UploadFile(ctx, file, withMetaFile any) *gomock.Call {
+func (mr *MockClientMockRecorder[K]) UploadFile(ctx, file, withMetaFile any, opts ...any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadFile", reflect.TypeOf((*MockClient[K])(nil).UploadFile), ctx, file, withMetaFile)
+	varargs := append([]any{ctx, file, withMetaFile}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadFile", reflect.TypeOf((*MockClient[K])(nil).UploadFile), varargs...)
+}
+
+// VerifyFile mocks base method.
+func (m *MockClient[K]) VerifyFile(ctx context.Context, fileKey string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "VerifyFile", ctx, fileKey)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// VerifyFile indicates an expected call of VerifyFile.
+func (mr *MockClientMockRecorder[K]) VerifyFile(ctx, fileKey any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyFile", reflect.TypeOf((*MockClient[K])(nil).VerifyFile), ctx, fileKey)
 }
 
 // MockS3Client is a mock of S3Client interface.
 type MockS3Client struct {
 	ctrl     *gomock.Controller
 	recorder *MockS3ClientMockRecorder
+	isgomock struct{}
 }
 
 // MockS3ClientMockRecorder is the mock recorder for MockS3Client.
@@ -122,6 +269,66 @@ func (m *MockS3Client) EXPECT() *MockS3ClientMockRecorder {
 	return m.recorder
 }
 
+// AbortMultipartUpload mocks base method.
+func (m *MockS3Client) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx, params}
+	for _, a := range optFns {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "AbortMultipartUpload", varargs...)
+	ret0, _ := ret[0].(*s3.AbortMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AbortMultipartUpload indicates an expected call of AbortMultipartUpload.
+func (mr *MockS3ClientMockRecorder) AbortMultipartUpload(ctx, params any, optFns ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx, params}, optFns...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AbortMultipartUpload", reflect.TypeOf((*MockS3Client)(nil).AbortMultipartUpload), varargs...)
+}
+
+// CompleteMultipartUpload mocks base method.
+func (m *MockS3Client) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx, params}
+	for _, a := range optFns {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "CompleteMultipartUpload", varargs...)
+	ret0, _ := ret[0].(*s3.CompleteMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompleteMultipartUpload indicates an expected call of CompleteMultipartUpload.
+func (mr *MockS3ClientMockRecorder) CompleteMultipartUpload(ctx, params any, optFns ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx, params}, optFns...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteMultipartUpload", reflect.TypeOf((*MockS3Client)(nil).CompleteMultipartUpload), varargs...)
+}
+
+// CreateMultipartUpload mocks base method.
+func (m *MockS3Client) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx, params}
+	for _, a := range optFns {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "CreateMultipartUpload", varargs...)
+	ret0, _ := ret[0].(*s3.CreateMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateMultipartUpload indicates an expected call of CreateMultipartUpload.
+func (mr *MockS3ClientMockRecorder) CreateMultipartUpload(ctx, params any, optFns ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx, params}, optFns...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateMultipartUpload", reflect.TypeOf((*MockS3Client)(nil).CreateMultipartUpload), varargs...)
+}
+
 // DeleteObjects mocks base method.
 func (m *MockS3Client) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
 	m.ctrl.T.Helper()
@@ -162,6 +369,26 @@ func (mr *MockS3ClientMockRecorder) GetObject(ctx, params any, optFns ...any) *g
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetObject", reflect.TypeOf((*MockS3Client)(nil).GetObject), varargs...)
 }
 
+// HeadObject mocks base method.
+func (m *MockS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx, params}
+	for _, a := range optFns {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "HeadObject", varargs...)
+	ret0, _ := ret[0].(*s3.HeadObjectOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// HeadObject indicates an expected call of HeadObject.
+func (mr *MockS3ClientMockRecorder) HeadObject(ctx, params any, optFns ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx, params}, optFns...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HeadObject", reflect.TypeOf((*MockS3Client)(nil).HeadObject), varargs...)
+}
+
 // PutObject mocks base method.
 func (m *MockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
 	m.ctrl.T.Helper()
@@ -181,3 +408,23 @@ func (mr *MockS3ClientMockRecorder) PutObject(ctx, params any, optFns ...any) *g
 	varargs := append([]any{ctx, params}, optFns...)
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutObject", reflect.TypeOf((*MockS3Client)(nil).PutObject), varargs...)
 }
+
+// UploadPart mocks base method.
+func (m *MockS3Client) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx, params}
+	for _, a := range optFns {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "UploadPart", varargs...)
+	ret0, _ := ret[0].(*s3.UploadPartOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UploadPart indicates an expected call of UploadPart.
+func (mr *MockS3ClientMockRecorder) UploadPart(ctx, params any, optFns ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx, params}, optFns...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadPart", reflect.TypeOf((*MockS3Client)(nil).UploadPart), varargs...)
+}
@@ -0,0 +1,203 @@
+package s3batchstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// defaultMultipartThreshold is the default size above which files are uploaded with a multipart upload.
+	// This is the maximum size allowed by s3 for a single PutObject request.
+	defaultMultipartThreshold int64 = 5 * 1024 * 1024 * 1024
+	// defaultPartSize is the default size of each part of a multipart upload
+	defaultPartSize int64 = 64 * 1024 * 1024
+	// minPartSize is the minimum size of each part (except the last one) allowed by s3
+	minPartSize int64 = 5 * 1024 * 1024
+	// maxParts is the maximum number of parts of a multipart upload allowed by s3
+	maxParts int64 = 10000
+	// defaultUploadConcurrency is the default number of parts uploaded in parallel
+	defaultUploadConcurrency = 4
+	// abortMultipartTimeout is the timeout to abort a failed multipart upload
+	abortMultipartTimeout = 30 * time.Second
+)
+
+// WithMultipartThreshold sets the file size in bytes above which the data file is uploaded with a multipart upload,
+// instead of a single PutObject request. Defaults to 5 GiB, which is the maximum size for a single request.
+func WithMultipartThreshold(size int64) UploadOption {
+	return func(o *uploadOptions) {
+		o.multipartThreshold = size
+	}
+}
+
+// WithPartSize sets the size in bytes of each part of a multipart upload. Defaults to 64 MiB.
+// The part size is increased if needed to respect the s3 limits of at least 5 MiB per part, and up to 10000 parts.
+func WithPartSize(size int64) UploadOption {
+	return func(o *uploadOptions) {
+		o.partSize = size
+	}
+}
+
+// WithUploadConcurrency sets how many parts of a multipart upload are uploaded in parallel. Defaults to 4.
+func WithUploadConcurrency(concurrency int) UploadOption {
+	return func(o *uploadOptions) {
+		o.uploadConcurrency = concurrency
+	}
+}
+
+// usesMultipart returns whether a file of the given size has to be uploaded with a multipart upload.
+func (o *uploadOptions) usesMultipart(size int64) bool {
+	threshold := o.multipartThreshold
+	if threshold <= 0 {
+		threshold = defaultMultipartThreshold
+	}
+	return size > threshold
+}
+
+// partSizeFor returns the size of the parts to upload a file of the given size.
+func (o *uploadOptions) partSizeFor(size int64) int64 {
+	partSize := o.partSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	// Round up, so that the file fits in the max number of parts
+	return max(partSize, minPartSize, (size+maxParts-1)/maxParts)
+}
+
+// multipartUpload uploads size bytes from body as the object described by input, splitting it in parts that are
+// uploaded concurrently. If any part fails, or the context is cancelled, the multipart upload is aborted so that
+// s3 doesn't keep the uploaded parts.
+func (c *client[K]) multipartUpload(ctx context.Context, input *s3.PutObjectInput, body io.ReaderAt, size int64, options *uploadOptions) error {
+	created, err := c.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		Tagging:              input.Tagging,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		BucketKeyEnabled:     input.BucketKeyEnabled,
+		StorageClass:         input.StorageClass,
+		CacheControl:         input.CacheControl,
+		ContentType:          input.ContentType,
+		Metadata:             input.Metadata,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		ChecksumAlgorithm:    input.ChecksumAlgorithm,
+		ChecksumType:         multipartChecksumType(input.ChecksumAlgorithm),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	parts, err := c.uploadParts(ctx, input, uploadID, body, size, options)
+	if err == nil {
+		complete := &s3.CompleteMultipartUploadInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			UploadId:             uploadID,
+			MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+			SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			SSECustomerKey:       input.SSECustomerKey,
+			SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+			IfNoneMatch:          input.IfNoneMatch,
+		}
+		if multipartChecksumType(input.ChecksumAlgorithm) == types.ChecksumTypeFullObject {
+			// s3 combines the checksums of the parts, and compares the result with the full object checksum
+			complete.ChecksumType = types.ChecksumTypeFullObject
+			complete.ChecksumCRC32C = input.ChecksumCRC32C
+			complete.ChecksumCRC64NVME = input.ChecksumCRC64NVME
+		}
+		_, err = c.s3Client.CompleteMultipartUpload(ctx, complete)
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	// Abort the upload even if the context was cancelled, to free the parts stored in s3
+	abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortMultipartTimeout)
+	defer cancel()
+	_, abortErr := c.s3Client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: uploadID,
+	})
+	if abortErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to abort multipart upload %s: %w", aws.ToString(uploadID), abortErr))
+	}
+	return err
+}
+
+// uploadParts uploads all the parts of a multipart upload, and returns them in order.
+// It stops on the first error, cancelling the pending uploads.
+func (c *client[K]) uploadParts(ctx context.Context, input *s3.PutObjectInput, uploadID *string, body io.ReaderAt, size int64, options *uploadOptions) ([]types.CompletedPart, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	partSize := options.partSizeFor(size)
+	numParts := (size + partSize - 1) / partSize
+	parts := make([]types.CompletedPart, numParts)
+
+	partNumbers := make(chan int32)
+	go func() {
+		defer close(partNumbers)
+		for i := range int32(numParts) {
+			select {
+			case partNumbers <- i + 1:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	concurrency := options.uploadConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultUploadConcurrency
+	}
+	var wg sync.WaitGroup
+	for range min(int64(concurrency), numParts) {
+		wg.Go(func() {
+			for partNumber := range partNumbers {
+				offset := int64(partNumber-1) * partSize
+				length := min(partSize, size-offset)
+				output, err := c.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:               input.Bucket,
+					Key:                  input.Key,
+					UploadId:             uploadID,
+					PartNumber:           aws.Int32(partNumber),
+					Body:                 io.NewSectionReader(body, offset, length),
+					ContentLength:        aws.Int64(length),
+					SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+					SSECustomerKey:       input.SSECustomerKey,
+					SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+					ChecksumAlgorithm:    input.ChecksumAlgorithm,
+				})
+				if err != nil {
+					cancel(fmt.Errorf("failed to upload part %d: %w", partNumber, err))
+					return
+				}
+				parts[partNumber-1] = types.CompletedPart{
+					PartNumber:        aws.Int32(partNumber),
+					ETag:              output.ETag,
+					ChecksumCRC32C:    output.ChecksumCRC32C,
+					ChecksumCRC64NVME: output.ChecksumCRC64NVME,
+					ChecksumSHA256:    output.ChecksumSHA256,
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
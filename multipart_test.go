@@ -0,0 +1,179 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestUploadOptions_PartSizeFor(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	o := uploadOptions{}
+	g.Expect(o.partSizeFor(100)).To(Equal(defaultPartSize))
+	g.Expect(o.partSizeFor(10000 * defaultPartSize)).To(Equal(defaultPartSize))
+	// Too many parts, so the part size is increased
+	g.Expect(o.partSizeFor(10000*defaultPartSize + 1)).To(Equal(defaultPartSize + 1))
+
+	// Parts smaller than the s3 minimum are not allowed
+	o = uploadOptions{partSize: 1024}
+	g.Expect(o.partSizeFor(100)).To(Equal(minPartSize))
+
+	g.Expect((&uploadOptions{}).usesMultipart(defaultMultipartThreshold)).To(BeFalse())
+	g.Expect((&uploadOptions{}).usesMultipart(defaultMultipartThreshold + 1)).To(BeTrue())
+	g.Expect((&uploadOptions{multipartThreshold: 10}).usesMultipart(11)).To(BeTrue())
+}
+
+func TestClient_UploadFileMultipart(t *testing.T) {
+	// 2 full parts and a smaller last one
+	payload := bytes.Repeat([]byte("0123456789abcdef"), int(2*minPartSize+1024)/16)
+
+	tests := []struct {
+		name           string
+		configureMocks func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client)
+		err            interface{}
+	}{
+		{
+			name: "successful upload",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				var mu sync.Mutex
+				uploaded := map[int32][]byte{}
+				s3Mock.EXPECT().UploadPart(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+					g.Expect(*input.Key).To(Equal(file.fileName))
+					g.Expect(*input.UploadId).To(Equal("upload-id"))
+					b, err := io.ReadAll(input.Body)
+					g.Expect(err).ToNot(HaveOccurred())
+					g.Expect(*input.ContentLength).To(Equal(int64(len(b))))
+
+					mu.Lock()
+					defer mu.Unlock()
+					uploaded[*input.PartNumber] = b
+					return &s3.UploadPartOutput{ETag: aws.String("etag-" + strconv.Itoa(int(*input.PartNumber)))}, nil
+				}).Times(3)
+				s3Mock.EXPECT().CompleteMultipartUpload(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+					g.Expect(*input.Key).To(Equal(file.fileName))
+					g.Expect(*input.UploadId).To(Equal("upload-id"))
+					g.Expect(input.MultipartUpload.Parts).To(Equal([]types.CompletedPart{
+						{PartNumber: aws.Int32(1), ETag: aws.String("etag-1")},
+						{PartNumber: aws.Int32(2), ETag: aws.String("etag-2")},
+						{PartNumber: aws.Int32(3), ETag: aws.String("etag-3")},
+					}))
+
+					g.Expect(uploaded[1]).To(HaveLen(int(minPartSize)))
+					g.Expect(uploaded[2]).To(HaveLen(int(minPartSize)))
+					g.Expect(bytes.Join([][]byte{uploaded[1], uploaded[2], uploaded[3]}, nil)).To(Equal(payload))
+					return &s3.CompleteMultipartUploadOutput{}, nil
+				})
+			},
+		},
+		{
+			name: "part upload error",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().UploadPart(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+					if *input.PartNumber == 2 {
+						return nil, errors.New("s3 service error")
+					}
+					return &s3.UploadPartOutput{ETag: aws.String("etag")}, nil
+				}).MinTimes(1).MaxTimes(3)
+				s3Mock.EXPECT().AbortMultipartUpload(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, input *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+					// The abort is not cancelled with the upload, but it has its own timeout
+					g.Expect(ctx.Err()).ToNot(HaveOccurred())
+					deadline, ok := ctx.Deadline()
+					g.Expect(ok).To(BeTrue())
+					g.Expect(deadline).To(BeTemporally("~", time.Now().Add(abortMultipartTimeout), time.Second))
+					g.Expect(*input.Key).To(Equal(file.fileName))
+					g.Expect(*input.UploadId).To(Equal("upload-id"))
+					return &s3.AbortMultipartUploadOutput{}, nil
+				})
+			},
+			err: "failed to upload data file to s3: failed to upload part 2: s3 service error",
+		},
+		{
+			name: "complete and abort errors",
+			configureMocks: func(g *WithT, file *TempFile[string], s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().UploadPart(gomock.Any(), gomock.Any()).Return(&s3.UploadPartOutput{ETag: aws.String("etag")}, nil).Times(3)
+				s3Mock.EXPECT().CompleteMultipartUpload(gomock.Any(), gomock.Any()).Return(nil, errors.New("s3 service error"))
+				s3Mock.EXPECT().AbortMultipartUpload(gomock.Any(), gomock.Any()).Return(nil, errors.New("abort error"))
+			},
+			err: "failed to upload data file to s3: failed to complete multipart upload: s3 service error\n" +
+				"failed to abort multipart upload upload-id: abort error",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			file, err := c.NewTempFile(testTags)
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+			g.Expect(file.Append("1", payload)).To(Succeed())
+
+			s3Mock.EXPECT().CreateMultipartUpload(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+				g.Expect(*input.Bucket).To(Equal(testBucketName))
+				g.Expect(*input.Key).To(Equal(file.fileName))
+				g.Expect(input.Tagging).To(Equal(aws.String("retention-days=14")))
+				g.Expect(input.StorageClass).To(Equal(types.StorageClassStandardIa))
+				return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil
+			})
+			test.configureMocks(g, file, s3Mock)
+
+			err = c.UploadFile(ctx, file, false,
+				WithMultipartThreshold(minPartSize),
+				WithPartSize(1024),
+				WithUploadConcurrency(2),
+				WithStorageClass(types.StorageClassStandardIa),
+			)
+			if test.err == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				g.Expect(err).To(MatchError(test.err))
+			}
+		})
+	}
+}
+
+func TestClient_UploadFileMultipartCreateError(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().CreateMultipartUpload(ctx, gomock.Any()).Return(nil, errors.New("s3 service error"))
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("my first payload"))).To(Succeed())
+
+	err = c.UploadFile(ctx, file, false, WithMultipartThreshold(1))
+	g.Expect(err).To(MatchError("failed to upload data file to s3: failed to create multipart upload: s3 service error"))
+}
@@ -0,0 +1,208 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies how the bytes of an object are compressed in the file.
+type Codec string
+
+const (
+	// CodecNone stores the objects as they are appended
+	CodecNone Codec = ""
+	// CodecZstd compresses each object with zstd
+	CodecZstd Codec = "zstd"
+)
+
+// maxDecodeBufferHint caps the buffer preallocated to decompress an object, as the uncompressed length comes from
+// the stored index, which may be corrupted. Larger payloads are still decoded, growing the buffer as needed.
+const maxDecodeBufferHint = 64 * 1024 * 1024
+
+// valid returns whether this codec is supported.
+func (c Codec) valid() bool {
+	return c == CodecNone || c == CodecZstd
+}
+
+// crc32cTable is used to compute the CRC32C checksums of the objects
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// zstdEncoder and zstdDecoder are shared by all the files and clients, as they are safe for concurrent use
+// when encoding/decoding whole payloads.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+)
+
+// encodeObject transforms the payload into the bytes to store in the file according to its options, and returns
+// them along with an ObjectIndex that describes how to decode them. The location fields of the index are not set.
+func (f *TempFile[K]) encodeObject(payload []byte) ([]byte, ObjectIndex, error) {
+	var index ObjectIndex
+	stored := payload
+
+	if f.codec == CodecZstd {
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, ObjectIndex{}, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		stored = encoder.EncodeAll(payload, nil)
+		index.Codec = CodecZstd
+		index.UncompressedLength = uint64(len(payload))
+	}
+
+	if f.dataKey != nil {
+		var err error
+		if stored, err = seal(f.dataKey, stored, []byte(f.fileName)); err != nil {
+			return nil, ObjectIndex{}, fmt.Errorf("failed to encrypt object: %w", err)
+		}
+		index.Encryption = EncryptionAES256GCM
+		index.WrappedKey = f.wrappedKey
+	}
+
+	if f.checksums {
+		index.CRC32C = aws.Uint32(crc32.Checksum(stored, crc32cTable))
+	}
+	return stored, index, nil
+}
+
+// decodeObject verifies the bytes downloaded for the given index, and transforms them back into the original payload.
+func (c *client[K]) decodeObject(ctx context.Context, ind ObjectIndex, stored []byte) ([]byte, error) {
+	if err := verifyObject(ind, stored); err != nil {
+		return nil, err
+	}
+
+	stored, err := c.decrypt(ctx, ind, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ind.Codec {
+	case CodecNone:
+		return stored, nil
+	case CodecZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		payload, err := decoder.DecodeAll(stored, make([]byte, 0, min(ind.UncompressedLength, maxDecodeBufferHint)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress object in file %s %s: %w", ind.File, byteRangeString(ind.Offset, ind.Length), err)
+		}
+		return payload, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %q for object in file %s %s", ind.Codec, ind.File, byteRangeString(ind.Offset, ind.Length))
+	}
+}
+
+// decrypt returns the plaintext of the stored bytes of the given index, if they are encrypted.
+func (c *client[K]) decrypt(ctx context.Context, ind ObjectIndex, stored []byte) ([]byte, error) {
+	switch ind.Encryption {
+	case "":
+		return stored, nil
+	case EncryptionAES256GCM:
+		dataKey, err := c.dataKey(ctx, ind)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt object in file %s %s: %w", ind.File, byteRangeString(ind.Offset, ind.Length), err)
+		}
+		plaintext, err := open(dataKey, stored, []byte(ind.File))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt object in file %s %s: %w", ind.File, byteRangeString(ind.Offset, ind.Length), err)
+		}
+		return plaintext, nil
+	default:
+		return nil, fmt.Errorf("unsupported encryption %q for object in file %s %s", ind.Encryption, ind.File, byteRangeString(ind.Offset, ind.Length))
+	}
+}
+
+// newDecodingReader wraps the reader of the stored bytes of the given index, to verify and decode them while reading.
+// Encrypted objects can't be decrypted while streaming, so they are fully read and decrypted in memory.
+func (c *client[K]) newDecodingReader(ctx context.Context, r io.ReadCloser, ind ObjectIndex) (io.ReadCloser, error) {
+	r = newVerifyingReader(r, ind)
+
+	if ind.Encryption != "" {
+		stored, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := c.decrypt(ctx, ind, stored)
+		if err != nil {
+			return nil, err
+		}
+		r = io.NopCloser(bytes.NewReader(plaintext))
+	}
+
+	switch ind.Codec {
+	case CodecNone:
+		return r, nil
+	case CodecZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return &zstdReadCloser{Decoder: decoder, body: r}, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %q for object in file %s %s", ind.Codec, ind.File, byteRangeString(ind.Offset, ind.Length))
+	}
+}
+
+// zstdReadCloser decompresses the body while reading it, and closes both the decoder and the body.
+type zstdReadCloser struct {
+	*zstd.Decoder
+	body io.Closer
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.body.Close()
+}
+
+// verifyObject checks that the bytes downloaded for the given index match its checksum, if it has one.
+func verifyObject(ind ObjectIndex, stored []byte) error {
+	if ind.CRC32C == nil {
+		return nil
+	}
+	if actual := crc32.Checksum(stored, crc32cTable); actual != *ind.CRC32C {
+		return &CorruptionError{Index: ind, Expected: *ind.CRC32C, Actual: actual}
+	}
+	return nil
+}
+
+// verifyingReader computes the checksum of the bytes read from the underlying reader, and once it is fully read,
+// verifies it against the checksum of the index, returning a *CorruptionError instead of io.EOF if they don't match.
+type verifyingReader struct {
+	io.ReadCloser
+	ind  ObjectIndex
+	hash hash.Hash32
+}
+
+// newVerifyingReader wraps the reader to verify the checksum of the index, if it has one.
+func newVerifyingReader(r io.ReadCloser, ind ObjectIndex) io.ReadCloser {
+	if ind.CRC32C == nil {
+		return r
+	}
+	return &verifyingReader{
+		ReadCloser: r,
+		ind:        ind,
+		hash:       crc32.New(crc32cTable),
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := r.hash.Sum32(); actual != *r.ind.CRC32C {
+			return n, &CorruptionError{Index: r.ind, Expected: *r.ind.CRC32C, Actual: actual}
+		}
+	}
+	return n, err
+}
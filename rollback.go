@@ -0,0 +1,116 @@
+package s3batchstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// rollbackAttempts is the number of times UploadFile tries to delete the uploaded files on a rollback
+	rollbackAttempts = 3
+	// rollbackRetryBackoff is the wait before the first retry of a failed rollback, it doubles after each attempt
+	rollbackRetryBackoff = 100 * time.Millisecond
+	// rollbackTimeout is the timeout of the whole rollback, including the retries
+	rollbackTimeout = 30 * time.Second
+)
+
+// WithRollback makes UploadFile delete the data file if the meta file can't be uploaded, so that a failed upload
+// doesn't leave an orphaned data file behind, retrying the deletion if it fails. Without this option, the caller
+// is responsible for calling DeleteFile.
+// Only the files written by the failed call are deleted: with WithNoOverwrite, the files that already existed in s3
+// are kept.
+// When the meta file upload fails, the returned error is an *UploadError that lists the deleted files, the ones that
+// may still exist, and the ones that already existed.
+func WithRollback() UploadOption {
+	return func(o *uploadOptions) {
+		o.rollback = true
+	}
+}
+
+// rollbackUpload deletes the files written by the upload of the given file after the meta file upload failed
+// with err, and returns an *UploadError with the outcome. dataWritten is whether the upload wrote the data file,
+// instead of finding it already in s3, and metaWritten whether it may have written the meta file, which is the case
+// even if the request failed, for example after a timeout.
+func (c *client[K]) rollbackUpload(ctx context.Context, file *TempFile[K], dataWritten, metaWritten bool, err error) error {
+	uploadErr := &UploadError{File: file.fileName, Err: err}
+	var keys []string
+	if dataWritten {
+		keys = append(keys, file.fileName)
+	} else {
+		uploadErr.Existing = append(uploadErr.Existing, file.fileName)
+	}
+	switch {
+	case errors.Is(err, ErrAlreadyExists):
+		uploadErr.Existing = append(uploadErr.Existing, file.MetaFileKey())
+	case metaWritten && dataWritten:
+		keys = append(keys, file.MetaFileKey())
+	case metaWritten:
+		// The data file already existed, so the meta file has the same contents as its own one, and it's kept
+		uploadErr.Remaining = append(uploadErr.Remaining, file.MetaFileKey())
+	}
+	if len(keys) == 0 {
+		return uploadErr
+	}
+
+	// Delete the files even if the context was cancelled, to avoid leaving them behind
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	remaining := keys
+	backoff := rollbackRetryBackoff
+	var rollbackErr error
+retry:
+	for attempt := range rollbackAttempts {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				rollbackErr = errors.Join(rollbackErr, ctx.Err())
+				break retry
+			}
+		}
+		remaining, rollbackErr = c.deleteObjects(ctx, remaining)
+		if rollbackErr == nil {
+			break
+		}
+	}
+
+	uploadErr.Deleted = slices.DeleteFunc(slices.Clone(keys), func(key string) bool {
+		return slices.Contains(remaining, key)
+	})
+	uploadErr.Remaining = append(remaining, uploadErr.Remaining...)
+	uploadErr.RollbackErr = rollbackErr
+	return uploadErr
+}
+
+// deleteObjects deletes the given keys, and returns the ones that could not be deleted along with the errors.
+func (c *client[K]) deleteObjects(ctx context.Context, keys []string) ([]string, error) {
+	objects := make([]types.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+	}
+	output, err := c.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: &c.s3Bucket,
+		Delete: &types.Delete{Objects: objects},
+	})
+	if err != nil {
+		return keys, fmt.Errorf("failed to delete files: %w", err)
+	}
+
+	var failed []string
+	var errs []error
+	for _, deleteErr := range output.Errors {
+		failed = append(failed, aws.ToString(deleteErr.Key))
+		errs = append(errs, fmt.Errorf("failed to delete file %s: %s: %s",
+			aws.ToString(deleteErr.Key), aws.ToString(deleteErr.Code), aws.ToString(deleteErr.Message)))
+	}
+	return failed, errors.Join(errs...)
+}
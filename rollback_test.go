@@ -0,0 +1,282 @@
+package s3batchstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestClient_UploadFileRollback(t *testing.T) {
+	const fileKey = "FILE"
+	const metaKey = "FILE" + metaFileSuffix
+	metaErr := errors.New("s3 service error")
+
+	deleteCall := func(g *WithT, s3Mock *mocks3.MockS3Client, keys []string, output *s3.DeleteObjectsOutput, err error) *gomock.Call {
+		return s3Mock.EXPECT().DeleteObjects(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, input *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+			// The rollback is not cancelled with the upload, but it has its own timeout
+			g.Expect(ctx.Err()).ToNot(HaveOccurred())
+			deadline, ok := ctx.Deadline()
+			g.Expect(ok).To(BeTrue())
+			g.Expect(deadline).To(BeTemporally("<=", time.Now().Add(rollbackTimeout)))
+			g.Expect(*input.Bucket).To(Equal(testBucketName))
+			var deleted []string
+			for _, object := range input.Delete.Objects {
+				deleted = append(deleted, *object.Key)
+			}
+			g.Expect(deleted).To(Equal(keys))
+			return output, err
+		})
+	}
+
+	tests := []struct {
+		name           string
+		configureMocks func(g *WithT, s3Mock *mocks3.MockS3Client)
+		expected       *UploadError
+		err            string
+	}{
+		{
+			name: "rolled back",
+			configureMocks: func(g *WithT, s3Mock *mocks3.MockS3Client) {
+				deleteCall(g, s3Mock, []string{fileKey, metaKey}, &s3.DeleteObjectsOutput{}, nil)
+			},
+			expected: &UploadError{File: fileKey, Deleted: []string{fileKey, metaKey}},
+			err:      "failed to upload meta file to s3: s3 service error, the upload of file FILE was rolled back",
+		},
+		{
+			name: "rolled back after retries",
+			configureMocks: func(g *WithT, s3Mock *mocks3.MockS3Client) {
+				gomock.InOrder(
+					deleteCall(g, s3Mock, []string{fileKey, metaKey}, nil, errors.New("timeout")),
+					deleteCall(g, s3Mock, []string{fileKey, metaKey}, &s3.DeleteObjectsOutput{
+						Errors: []types.Error{{Key: aws.String(fileKey), Code: aws.String("InternalError"), Message: aws.String("try again")}},
+					}, nil),
+					deleteCall(g, s3Mock, []string{fileKey}, &s3.DeleteObjectsOutput{}, nil),
+				)
+			},
+			expected: &UploadError{File: fileKey, Deleted: []string{fileKey, metaKey}},
+			err:      "failed to upload meta file to s3: s3 service error, the upload of file FILE was rolled back",
+		},
+		{
+			name: "rollback failed",
+			configureMocks: func(g *WithT, s3Mock *mocks3.MockS3Client) {
+				deleteCall(g, s3Mock, []string{fileKey, metaKey}, &s3.DeleteObjectsOutput{
+					Errors: []types.Error{{Key: aws.String(fileKey), Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")}},
+				}, nil)
+				deleteCall(g, s3Mock, []string{fileKey}, &s3.DeleteObjectsOutput{
+					Errors: []types.Error{{Key: aws.String(fileKey), Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")}},
+				}, nil).Times(2)
+			},
+			expected: &UploadError{
+				File:        fileKey,
+				Deleted:     []string{metaKey},
+				Remaining:   []string{fileKey},
+				RollbackErr: errors.New("failed to delete file FILE: AccessDenied: Access Denied"),
+			},
+			err: "failed to upload meta file to s3: s3 service error, and failed to roll back the upload of file FILE: " +
+				"failed to delete file FILE: AccessDenied: Access Denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx, cancel := context.WithCancel(context.Background())
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+			file, err := c.NewTempFile(testTags, WithKeyStrategy(KeyStrategyFunc(func(FileKeyInput) string { return fileKey })))
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+			g.Expect(file.Append("1", []byte("payload"))).To(Succeed())
+
+			s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(fileKey)).Return(&s3.PutObjectOutput{}, nil)
+			s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(metaKey)).DoAndReturn(func(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+				// The rollback happens even if the context is cancelled
+				cancel()
+				return nil, metaErr
+			})
+			tt.configureMocks(g, s3Mock)
+
+			err = c.UploadFile(ctx, file, true, WithRollback())
+			g.Expect(err).To(MatchError(tt.err))
+			g.Expect(err).To(MatchError(metaErr))
+
+			var uploadErr *UploadError
+			g.Expect(errors.As(err, &uploadErr)).To(BeTrue())
+			g.Expect(uploadErr.File).To(Equal(tt.expected.File))
+			g.Expect(uploadErr.Deleted).To(Equal(tt.expected.Deleted))
+			g.Expect(uploadErr.Remaining).To(Equal(tt.expected.Remaining))
+			g.Expect(uploadErr.Err).To(MatchError("failed to upload meta file to s3: s3 service error"))
+			if tt.expected.RollbackErr == nil {
+				g.Expect(uploadErr.RollbackErr).ToNot(HaveOccurred())
+			} else {
+				g.Expect(uploadErr.RollbackErr).To(MatchError(tt.expected.RollbackErr.Error()))
+			}
+		})
+	}
+}
+
+func TestClient_UploadFileRollbackNoOverwrite(t *testing.T) {
+	const fileKey = "FILE"
+	const metaKey = "FILE" + metaFileSuffix
+	const dataChecksum = "4waSgw==" // CRC32C of the file contents
+	preconditionFailed := &smithy.GenericAPIError{Code: "PreconditionFailed"}
+
+	existingData := func(s3Mock *mocks3.MockS3Client) {
+		// The same data file was already uploaded
+		s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(fileKey)).Return(nil, preconditionFailed)
+		s3Mock.EXPECT().HeadObject(gomock.Any(), &s3.HeadObjectInput{
+			Bucket: aws.String(testBucketName), Key: aws.String(fileKey), ChecksumMode: types.ChecksumModeEnabled,
+		}).Return(&s3.HeadObjectOutput{Metadata: map[string]string{
+			checksumAlgorithmMetadataKey: "CRC32C",
+			checksumMetadataKey:          dataChecksum,
+		}}, nil)
+	}
+	differentMeta := func(s3Mock *mocks3.MockS3Client) {
+		// A different meta file already exists
+		s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(metaKey)).Return(nil, preconditionFailed)
+		s3Mock.EXPECT().HeadObject(gomock.Any(), &s3.HeadObjectInput{
+			Bucket: aws.String(testBucketName), Key: aws.String(metaKey), ChecksumMode: types.ChecksumModeEnabled,
+		}).Return(&s3.HeadObjectOutput{ChecksumCRC32C: aws.String("AAAAAA==")}, nil)
+	}
+
+	const differentMetaErr = "failed to upload meta file to s3: file already exists: test-bucket/" + metaKey +
+		", with a different checksum"
+
+	tests := []struct {
+		name           string
+		configureMocks func(s3Mock *mocks3.MockS3Client)
+		deleted        []string
+		remaining      []string
+		existing       []string
+		err            string
+	}{
+		{
+			name: "existing meta file",
+			configureMocks: func(s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(fileKey)).Return(&s3.PutObjectOutput{}, nil)
+				differentMeta(s3Mock)
+			},
+			deleted:  []string{fileKey},
+			existing: []string{metaKey},
+			err: differentMetaErr + ", the upload of file FILE was rolled back, " +
+				"the files that already existed were kept: " + metaKey,
+		},
+		{
+			name: "existing data and meta files",
+			configureMocks: func(s3Mock *mocks3.MockS3Client) {
+				existingData(s3Mock)
+				differentMeta(s3Mock)
+			},
+			existing: []string{fileKey, metaKey},
+			err: differentMetaErr + ", nothing was deleted to roll back the upload of file FILE, " +
+				"the files that already existed were kept: FILE, " + metaKey,
+		},
+		{
+			name: "existing data file and meta file error",
+			configureMocks: func(s3Mock *mocks3.MockS3Client) {
+				existingData(s3Mock)
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(metaKey)).Return(nil, errors.New("timeout"))
+			},
+			// The meta file may have been written, with the same contents as the one of the existing data file
+			remaining: []string{metaKey},
+			existing:  []string{fileKey},
+			err: "failed to upload meta file to s3: timeout, nothing was deleted to roll back the upload of file FILE, " +
+				"the files that already existed were kept: FILE, the files that may still exist: " + metaKey,
+		},
+		{
+			name: "meta file error",
+			configureMocks: func(s3Mock *mocks3.MockS3Client) {
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(fileKey)).Return(&s3.PutObjectOutput{}, nil)
+				s3Mock.EXPECT().PutObject(gomock.Any(), matchUploadParams(metaKey)).Return(nil, errors.New("timeout"))
+			},
+			deleted: []string{fileKey, metaKey},
+			err:     "failed to upload meta file to s3: timeout, the upload of file FILE was rolled back",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+			file, err := c.NewTempFile(testTags, WithKeyStrategy(KeyStrategyFunc(func(FileKeyInput) string { return fileKey })))
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+			g.Expect(file.Append("1", []byte("123456789"))).To(Succeed())
+
+			tt.configureMocks(s3Mock)
+			// Only the files written by this call are deleted, never the ones that already existed
+			if tt.deleted != nil {
+				s3Mock.EXPECT().DeleteObjects(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+					var deleted []string
+					for _, object := range input.Delete.Objects {
+						deleted = append(deleted, *object.Key)
+					}
+					g.Expect(deleted).To(Equal(tt.deleted))
+					return &s3.DeleteObjectsOutput{}, nil
+				})
+			}
+
+			err = c.UploadFile(ctx, file, true, WithNoOverwrite(), WithRollback())
+			g.Expect(err).To(MatchError(tt.err))
+			var uploadErr *UploadError
+			g.Expect(errors.As(err, &uploadErr)).To(BeTrue())
+			g.Expect(uploadErr.Deleted).To(Equal(tt.deleted))
+			g.Expect(uploadErr.Remaining).To(Equal(tt.remaining))
+			g.Expect(uploadErr.Existing).To(Equal(tt.existing))
+			g.Expect(uploadErr.RollbackErr).ToNot(HaveOccurred())
+		})
+	}
+}
+
+func TestClient_UploadFileWithoutRollback(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	// Without the option, the data file is left for the caller to delete
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.fileName)).Return(&s3.PutObjectOutput{}, nil)
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.MetaFileKey())).Return(nil, errors.New("s3 service error"))
+	err = c.UploadFile(ctx, file, true)
+	g.Expect(err).To(MatchError("failed to upload meta file to s3: s3 service error"))
+
+	// Nothing is rolled back if the data file upload fails
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.fileName)).Return(nil, errors.New("s3 service error"))
+	err = c.UploadFile(ctx, file, true, WithRollback())
+	g.Expect(err).To(MatchError("failed to upload data file to s3: s3 service error"))
+}
@@ -0,0 +1,95 @@
+package s3batchstore
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+func (c *client[K]) Scan(ctx context.Context, fileKey string, fn func(id K, payload []byte) error) error {
+	indexes, err := c.LoadIndexes(ctx, fileKey)
+	if err != nil {
+		return err
+	}
+	entries := sortedByOffset(indexes)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Download only the bytes between the first and the last object, in one single request.
+	start := entries[0].Offset
+	end := start
+	for _, e := range entries {
+		end = max(end, e.Offset+e.Length)
+	}
+	var r io.Reader = bytes.NewReader(nil)
+	if end > start {
+		body, err := c.openRange(ctx, fileKey, start, end-start)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = body.Close() }()
+		r = bufio.NewReader(body)
+	}
+
+	pos := start
+	for _, e := range entries {
+		if e.Offset < pos {
+			return fmt.Errorf("object %v in file %s/%s overlaps with the previous object", e.id, c.s3Bucket, fileKey)
+		}
+
+		// Skip the bytes that don't belong to any object, like the ones of overwritten objects
+		if _, err = io.CopyN(io.Discard, r, int64(e.Offset-pos)); err != nil {
+			return fmt.Errorf("failed to read file %s/%s at offset %d: %w", c.s3Bucket, fileKey, pos, err)
+		}
+
+		payload, err := readObject(r, e.Length)
+		if err != nil {
+			return fmt.Errorf("failed to read object %v from file %s/%s %s: %w", e.id, c.s3Bucket, fileKey, byteRangeString(e.Offset, e.Length), err)
+		}
+		pos = e.Offset + e.Length
+		if payload, err = c.decodeObject(ctx, e.ObjectIndex, payload); err != nil {
+			return err
+		}
+
+		if err = fn(e.id, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readObject reads an object of the given length from r. The length comes from the stored index, which may be
+// corrupted, so the buffer grows with the bytes actually read instead of being allocated upfront.
+func readObject(r io.Reader, length uint64) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, min(length, maxDecodeBufferHint)))
+	n, err := io.CopyN(buf, r, int64(min(length, math.MaxInt64)))
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// indexEntry is an object index along with the id of the object.
+type indexEntry[K comparable] struct {
+	id K
+	ObjectIndex
+}
+
+// sortedByOffset returns the entries of the indexes map sorted by their offset in the file.
+func sortedByOffset[K comparable](indexes map[K]ObjectIndex) []indexEntry[K] {
+	entries := make([]indexEntry[K], 0, len(indexes))
+	for id, ind := range indexes {
+		entries = append(entries, indexEntry[K]{id: id, ObjectIndex: ind})
+	}
+	slices.SortFunc(entries, func(a, b indexEntry[K]) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	return entries
+}
@@ -0,0 +1,159 @@
+package s3batchstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestClient_Scan(t *testing.T) {
+	const fileKey = "file"
+	// The "xxxxx" bytes belong to an overwritten object, and the trailing "zzz" are not part of any object
+	contents := []byte("aaaaaxxxxxbbbbbcccccdddddzzz")
+
+	tests := []struct {
+		name          string
+		indexes       map[string]ObjectIndex
+		expectedRange string
+		expectedIDs   []string
+		expected      []string
+		fnErr         error
+		err           interface{}
+	}{
+		{
+			name: "all objects in offset order",
+			indexes: map[string]ObjectIndex{
+				"d": {File: fileKey, Offset: 20, Length: 5},
+				"a": {File: fileKey, Offset: 0, Length: 5},
+				"c": {File: fileKey, Offset: 15, Length: 5},
+				"b": {File: fileKey, Offset: 10, Length: 5},
+			},
+			expectedRange: "bytes=0-24",
+			expectedIDs:   []string{"a", "b", "c", "d"},
+			expected:      []string{"aaaaa", "bbbbb", "ccccc", "ddddd"},
+		},
+		{
+			name: "only downloads the needed range",
+			indexes: map[string]ObjectIndex{
+				"c": {File: fileKey, Offset: 15, Length: 5},
+				"b": {File: fileKey, Offset: 10, Length: 5},
+			},
+			expectedRange: "bytes=10-19",
+			expectedIDs:   []string{"b", "c"},
+			expected:      []string{"bbbbb", "ccccc"},
+		},
+		{
+			name:    "empty file",
+			indexes: map[string]ObjectIndex{},
+		},
+		{
+			name: "callback error stops the scan",
+			indexes: map[string]ObjectIndex{
+				"a": {File: fileKey, Offset: 0, Length: 5},
+				"b": {File: fileKey, Offset: 10, Length: 5},
+			},
+			expectedRange: "bytes=0-14",
+			expectedIDs:   []string{"a"},
+			expected:      []string{"aaaaa"},
+			fnErr:         errors.New("callback error"),
+			err:           "callback error",
+		},
+		{
+			name: "overlapping objects",
+			indexes: map[string]ObjectIndex{
+				"a": {File: fileKey, Offset: 0, Length: 10},
+				"b": {File: fileKey, Offset: 5, Length: 5},
+			},
+			expectedRange: "bytes=0-9",
+			expectedIDs:   []string{"a"},
+			expected:      []string{"aaaaaxxxxx"},
+			err:           "object b in file test-bucket/file overlaps with the previous object",
+		},
+		{
+			name: "object beyond the end of the file",
+			indexes: map[string]ObjectIndex{
+				"a": {File: fileKey, Offset: 25, Length: 10},
+			},
+			expectedRange: "bytes=25-34",
+			err:           "failed to read object a from file test-bucket/file bytes=25-34: unexpected EOF",
+		},
+		{
+			name: "corrupted length",
+			indexes: map[string]ObjectIndex{
+				"a": {File: fileKey, Offset: 0, Length: math.MaxInt64},
+			},
+			expectedRange: "bytes=0-9223372036854775806",
+			err:           "failed to read object a from file test-bucket/file bytes=0-9223372036854775806: unexpected EOF",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			metaBody, err := encodeMetaFile(&MetaFile[string]{Entries: test.indexes}, MetaFileV2, StringKeyCodec[string]())
+			g.Expect(err).ToNot(HaveOccurred())
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				if *input.Key == metaFileKey(fileKey) {
+					return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(metaBody))}, nil
+				}
+				g.Expect(*input.Key).To(Equal(fileKey))
+				g.Expect(*input.Range).To(Equal(test.expectedRange))
+				return getObjectFromBytes(g, contents, input)
+			}).MinTimes(1).MaxTimes(2)
+
+			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
+				s3Bucket: testBucketName,
+				s3Client: s3Mock,
+			}
+
+			var ids, payloads []string
+			err = c.Scan(ctx, fileKey, func(id string, payload []byte) error {
+				ids = append(ids, id)
+				payloads = append(payloads, string(payload))
+				return test.fnErr
+			})
+			if test.err == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				g.Expect(err).To(MatchError(test.err))
+			}
+			g.Expect(ids).To(Equal(test.expectedIDs))
+			g.Expect(payloads).To(Equal(test.expected))
+		})
+	}
+}
+
+func TestClient_ScanMetaFileError(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().GetObject(ctx, gomock.Any()).Return(nil, errors.New("error connecting to s3")).Times(1)
+
+	c := &client[string]{
+		idCodec:  StringKeyCodec[string](),
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	err := c.Scan(ctx, "file", func(string, []byte) error {
+		g.Fail("callback should not be called")
+		return nil
+	})
+	g.Expect(err).To(MatchError("failed to download meta file test-bucket/file.meta.json.zst: error connecting to s3"))
+}
@@ -0,0 +1,164 @@
+package s3batchstore
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// TempStorage is where a TempFile keeps the bytes of its objects until the file is uploaded.
+// Writes always happen at the current position, which TempFile moves with Seek and Truncate to discard failed
+// appends. Once the file is uploaded, the contents are read from the start with Read, or concurrently with ReadAt
+// for multipart uploads. Close releases the storage, deleting its contents.
+// *os.File implements all the methods, but its Close doesn't delete the file.
+type TempStorage interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	Truncate(size int64) error
+	Name() string
+	Close() error
+}
+
+// TempStorageFactory creates the TempStorage of a new TempFile, name is a unique ULID generated for the file.
+type TempStorageFactory func(name string) (TempStorage, error)
+
+// WithTempDir makes the TempFile store its contents in a file in the given directory, instead of the default
+// directory for temporary files (see os.TempDir). This allows to use a dedicated volume for the temp files.
+func WithTempDir(dir string) TempFileOption {
+	return WithTempStorage(func(name string) (TempStorage, error) {
+		return newDiskStorage(dir, name)
+	})
+}
+
+// WithMemoryStorage makes the TempFile keep its contents in memory, instead of in a file. This is useful for small
+// files, or when the filesystem is read-only.
+func WithMemoryStorage() TempFileOption {
+	return WithTempStorage(func(name string) (TempStorage, error) {
+		return &memoryStorage{name: name}, nil
+	})
+}
+
+// WithTempStorage sets how the TempFile creates the storage for its contents.
+// By default, the contents are stored in a file in os.TempDir(), which is deleted when the TempFile is closed.
+func WithTempStorage(factory TempStorageFactory) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.storageFactory = factory
+	}
+}
+
+// diskStorage is a TempStorage backed by a file, which is deleted on Close.
+type diskStorage struct {
+	*os.File
+}
+
+func newDiskStorage(dir, name string) (*diskStorage, error) {
+	file, err := os.CreateTemp(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &diskStorage{File: file}, nil
+}
+
+// Close closes and deletes the file. It doesn't fail if the file was already closed, as long as it can be deleted.
+func (s *diskStorage) Close() error {
+	err := s.File.Close()
+	if errors.Is(err, os.ErrClosed) {
+		err = nil
+	}
+	return errors.Join(err, os.Remove(s.Name()))
+}
+
+// memoryStorage is a TempStorage that keeps the contents in memory.
+type memoryStorage struct {
+	name   string
+	buf    []byte
+	pos    int64
+	closed bool
+}
+
+func (s *memoryStorage) Name() string {
+	return s.name
+}
+
+func (s *memoryStorage) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, s.closedError("write")
+	}
+	end := s.pos + int64(len(p))
+	if end > int64(len(s.buf)) {
+		s.buf = append(s.buf, make([]byte, end-int64(len(s.buf)))...)
+	}
+	copy(s.buf[s.pos:], p)
+	s.pos = end
+	return len(p), nil
+}
+
+func (s *memoryStorage) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *memoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	if s.closed {
+		return 0, s.closedError("read")
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: s.name, Err: errors.New("negative offset")}
+	}
+	if off >= int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memoryStorage) Seek(offset int64, whence int) (int64, error) {
+	if s.closed {
+		return 0, s.closedError("seek")
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += int64(len(s.buf))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: s.name, Err: errors.New("negative position")}
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+func (s *memoryStorage) Truncate(size int64) error {
+	if s.closed {
+		return s.closedError("truncate")
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: s.name, Err: errors.New("negative size")}
+	}
+	if size <= int64(len(s.buf)) {
+		s.buf = s.buf[:size]
+	} else {
+		s.buf = append(s.buf, make([]byte, size-int64(len(s.buf)))...)
+	}
+	return nil
+}
+
+// Close releases the contents.
+func (s *memoryStorage) Close() error {
+	s.closed = true
+	s.buf = nil
+	return nil
+}
+
+// closedError returns the same error as an *os.File when it is used after being closed.
+func (s *memoryStorage) closedError(op string) error {
+	return &os.PathError{Op: op, Path: s.name, Err: os.ErrClosed}
+}
@@ -0,0 +1,144 @@
+package s3batchstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s := &memoryStorage{name: "file"}
+	g.Expect(s.Name()).To(Equal("file"))
+
+	n, err := s.Write([]byte("hello world"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(n).To(Equal(11))
+
+	// Discard the last bytes, like TempFile does when an append fails
+	g.Expect(s.Truncate(5)).To(Succeed())
+	pos, err := s.Seek(5, io.SeekStart)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pos).To(Equal(int64(5)))
+	_, err = s.Write([]byte(", gophers"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	buf := make([]byte, 7)
+	n, err = s.ReadAt(buf, 7)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(buf[:n])).To(Equal("gophers"))
+	n, err = s.ReadAt(buf, 10)
+	g.Expect(err).To(Equal(io.EOF))
+	g.Expect(string(buf[:n])).To(Equal("hers"))
+
+	_, err = s.Seek(0, io.SeekStart)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(iotest.TestReader(s, []byte("hello, gophers"))).To(Succeed())
+
+	pos, err = s.Seek(-2, io.SeekEnd)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pos).To(Equal(int64(12)))
+	pos, err = s.Seek(1, io.SeekCurrent)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pos).To(Equal(int64(13)))
+	_, err = s.Seek(-20, io.SeekCurrent)
+	g.Expect(err).To(MatchError("seek file: negative position"))
+
+	// Writing past the end fills the gap with zeros
+	_, err = s.Seek(16, io.SeekStart)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = s.Write([]byte("!"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(s.buf).To(Equal([]byte("hello, gophers\x00\x00!")))
+
+	g.Expect(s.Close()).To(Succeed())
+	_, err = s.Write([]byte("more"))
+	g.Expect(err).To(MatchError(os.ErrClosed))
+	g.Expect(err).To(MatchError("write file: file already closed"))
+	_, err = s.Read(buf)
+	g.Expect(err).To(MatchError(os.ErrClosed))
+	_, err = s.Seek(0, io.SeekStart)
+	g.Expect(err).To(MatchError(os.ErrClosed))
+	g.Expect(s.Truncate(0)).To(MatchError(os.ErrClosed))
+}
+
+func TestNewTempFile_WithTempDir(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := t.TempDir()
+
+	file, err := NewTempFile[string](testTags, WithTempDir(dir))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(filepath.Dir(file.file.Name())).To(Equal(dir))
+
+	g.Expect(file.Append("1", []byte("payload"))).To(Succeed())
+	g.Expect(string(tempFileContents(g, file))).To(Equal("payload"))
+
+	// Closing the file deletes it
+	g.Expect(file.Close()).To(Succeed())
+	_, err = os.Stat(file.file.Name())
+	g.Expect(err).To(MatchError(os.ErrNotExist))
+
+	// The directory must exist
+	_, err = NewTempFile[string](testTags, WithTempDir(filepath.Join(dir, "missing")))
+	g.Expect(err).To(MatchError(os.ErrNotExist))
+}
+
+func TestNewTempFile_CustomStorage(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := NewTempFile[string](testTags, WithTempStorage(func(string) (TempStorage, error) {
+		return nil, errors.New("no space left")
+	}))
+	g.Expect(err).To(MatchError("no space left"))
+}
+
+func TestFile_MemoryStorage(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	c := client[string]{
+		idCodec:       StringKeyCodec[string](),
+		clientOptions: clientOptions{tempFileOpts: []TempFileOption{WithMemoryStorage(), WithChecksums()}},
+	}
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.file).To(BeAssignableToTypeOf(&memoryStorage{}))
+
+	g.Expect(file.Append("1", []byte("my first payload"))).To(Succeed())
+	_, err = file.AppendReader("2", io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("read error"))))
+	g.Expect(err).To(MatchError(fmt.Sprintf("failed to append object to file %s: read error", file.file.Name())))
+	index, err := file.AppendReader("3", strings.NewReader("my third payload"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.Offset).To(Equal(uint64(len("my first payload"))))
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.fileName)).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(string(body)).To(Equal("my first payloadmy third payload"))
+		return &s3.PutObjectOutput{}, nil
+	})
+	c.s3Bucket = testBucketName
+	c.s3Client = s3Mock
+	g.Expect(c.UploadFile(ctx, file, false)).To(Succeed())
+
+	// Once closed, the contents are released
+	g.Expect(file.Close()).To(Succeed())
+	_, err = file.file.ReadAt(make([]byte, 1), 0)
+	g.Expect(err).To(MatchError(os.ErrClosed))
+	g.Expect(file.file.(*memoryStorage).buf).To(BeNil())
+}
@@ -0,0 +1,112 @@
+package s3batchstore
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// s3 limits for the tags of an object
+const (
+	maxTags           = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	reservedTagPrefix = "aws:"
+)
+
+// tagReplacementChar replaces the characters not allowed by s3 when normalizing the tags
+const tagReplacementChar = '_'
+
+// WithTagNormalization makes NewTempFile sanitize the tags to respect the s3 limits, instead of rejecting them:
+// characters not allowed by s3 are replaced by '_', and keys and values are truncated to their max length.
+// Tags that can't be fixed, like having more than 10 tags, or keys using the reserved "aws:" prefix, are still
+// rejected with a *TagValidationError.
+func WithTagNormalization() TempFileOption {
+	return func(o *tempFileOptions) {
+		o.normalizeTags = true
+	}
+}
+
+// validTagChar returns whether the character is allowed by s3 in tag keys and values.
+func validTagChar(r rune) bool {
+	return unicode.In(r, unicode.L, unicode.Z, unicode.N) || strings.ContainsRune("_.:/=+-@", r)
+}
+
+// normalizeTags returns a copy of the tags where the invalid characters are replaced, and keys and values are
+// truncated to the max length. The keys that end up being the same after normalizing them are reported as invalid.
+func normalizeTags(tags map[string]string) (map[string]string, []InvalidTag) {
+	normalized := make(map[string]string, len(tags))
+	originalKeys := make(map[string]string, len(tags))
+	var invalid []InvalidTag
+	// Iterate in order, so that the reported collisions are deterministic
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		normalizedKey := normalizeTagText(key, maxTagKeyLength)
+		if original, ok := originalKeys[normalizedKey]; ok {
+			invalid = append(invalid, InvalidTag{
+				Key:    key,
+				Value:  tags[key],
+				Reason: fmt.Sprintf("key is the same as %q after normalizing it", original),
+			})
+			continue
+		}
+		originalKeys[normalizedKey] = key
+		normalized[normalizedKey] = normalizeTagText(tags[key], maxTagValueLength)
+	}
+	return normalized, invalid
+}
+
+// normalizeTagText replaces the characters not allowed in tags, and truncates the text to maxLength characters.
+func normalizeTagText(text string, maxLength int) string {
+	var b strings.Builder
+	length := 0
+	for _, r := range text {
+		if length == maxLength {
+			break
+		}
+		if !validTagChar(r) {
+			r = tagReplacementChar
+		}
+		b.WriteRune(r)
+		length++
+	}
+	return b.String()
+}
+
+// validateTags checks the tags against the s3 limits, returning a *TagValidationError listing the problems found.
+func validateTags(tags map[string]string, invalid []InvalidTag) error {
+	for key, value := range tags {
+		var reasons []string
+		switch {
+		case key == "":
+			reasons = append(reasons, "key is empty")
+		case utf8.RuneCountInString(key) > maxTagKeyLength:
+			reasons = append(reasons, fmt.Sprintf("key is longer than %d characters", maxTagKeyLength))
+		}
+		if strings.HasPrefix(strings.ToLower(key), reservedTagPrefix) {
+			reasons = append(reasons, fmt.Sprintf("key uses the reserved prefix %q", reservedTagPrefix))
+		}
+		if strings.IndexFunc(key, func(r rune) bool { return !validTagChar(r) }) >= 0 {
+			reasons = append(reasons, "key has characters that are not allowed")
+		}
+		if utf8.RuneCountInString(value) > maxTagValueLength {
+			reasons = append(reasons, fmt.Sprintf("value is longer than %d characters", maxTagValueLength))
+		}
+		if strings.IndexFunc(value, func(r rune) bool { return !validTagChar(r) }) >= 0 {
+			reasons = append(reasons, "value has characters that are not allowed")
+		}
+		if len(reasons) > 0 {
+			invalid = append(invalid, InvalidTag{Key: key, Value: value, Reason: strings.Join(reasons, ", ")})
+		}
+	}
+
+	tooMany := len(tags) > maxTags
+	if !tooMany && len(invalid) == 0 {
+		return nil
+	}
+	slices.SortFunc(invalid, func(a, b InvalidTag) int { return cmp.Compare(a.Key, b.Key) })
+	return &TagValidationError{Count: len(tags), Invalid: invalid}
+}
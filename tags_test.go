@@ -0,0 +1,155 @@
+package s3batchstore
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestNewTempFile_TagValidation(t *testing.T) {
+	tooManyTags := map[string]string{}
+	for _, key := range strings.Split("a b c d e f g h i j k", " ") {
+		tooManyTags[key] = "value"
+	}
+
+	tests := []struct {
+		name    string
+		tags    map[string]string
+		opts    []TempFileOption
+		want    map[string]string
+		invalid []InvalidTag
+		count   int
+		err     string
+	}{
+		{
+			name: "valid tags",
+			tags: map[string]string{"retention-days": "14", "path": "a/b c:d=e+f@g.h_i", "ñandú": "día"},
+			want: map[string]string{"retention-days": "14", "path": "a/b c:d=e+f@g.h_i", "ñandú": "día"},
+		},
+		{
+			name: "no tags",
+			tags: nil,
+		},
+		{
+			name:  "too many tags",
+			tags:  tooManyTags,
+			count: 11,
+			err:   "invalid tags: 11 tags, the limit is 10",
+		},
+		{
+			name: "invalid tags",
+			tags: map[string]string{
+				"":                       "empty",
+				"aws:createdBy":          "me",
+				"team#1":                 "backend",
+				"service":                "api*",
+				strings.Repeat("k", 129): "long",
+				"long-value":             strings.Repeat("v", 257),
+				"ok":                     "ok",
+			},
+			count: 7,
+			invalid: []InvalidTag{
+				{Key: "", Value: "empty", Reason: "key is empty"},
+				{Key: "aws:createdBy", Value: "me", Reason: `key uses the reserved prefix "aws:"`},
+				{Key: strings.Repeat("k", 129), Value: "long", Reason: "key is longer than 128 characters"},
+				{Key: "long-value", Value: strings.Repeat("v", 257), Reason: "value is longer than 256 characters"},
+				{Key: "service", Value: "api*", Reason: "value has characters that are not allowed"},
+				{Key: "team#1", Value: "backend", Reason: "key has characters that are not allowed"},
+			},
+		},
+		{
+			name: "normalized tags",
+			tags: map[string]string{
+				"team#1":                 "backend",
+				"service":                "api*",
+				strings.Repeat("k", 129): "long",
+				"long-value":             strings.Repeat("v", 257),
+				"ok":                     "ok",
+			},
+			opts: []TempFileOption{WithTagNormalization()},
+			want: map[string]string{
+				"team_1":                 "backend",
+				"service":                "api_",
+				strings.Repeat("k", 128): "long",
+				"long-value":             strings.Repeat("v", 256),
+				"ok":                     "ok",
+			},
+		},
+		{
+			name:  "normalized tags with the reserved prefix",
+			tags:  map[string]string{"AWS:createdBy": "me"},
+			opts:  []TempFileOption{WithTagNormalization()},
+			count: 1,
+			invalid: []InvalidTag{
+				{Key: "AWS:createdBy", Value: "me", Reason: `key uses the reserved prefix "aws:"`},
+			},
+		},
+		{
+			name:  "normalized keys collide",
+			tags:  map[string]string{"team#1": "backend", "team*1": "frontend"},
+			opts:  []TempFileOption{WithTagNormalization()},
+			count: 1, // The colliding tag is dropped
+			invalid: []InvalidTag{
+				{Key: "team*1", Value: "frontend", Reason: `key is the same as "team#1" after normalizing it`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			file, err := NewTempFile[string](tt.tags, tt.opts...)
+			if tt.err == "" && tt.invalid == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+				defer func() { _ = file.Close() }()
+				if tt.want == nil {
+					g.Expect(file.Tags()).To(BeEmpty())
+				} else {
+					g.Expect(file.Tags()).To(Equal(tt.want))
+				}
+				return
+			}
+
+			g.Expect(file).To(BeNil())
+			var validationErr *TagValidationError
+			g.Expect(err).To(BeAssignableToTypeOf(validationErr))
+			validationErr = err.(*TagValidationError)
+			g.Expect(validationErr.Count).To(Equal(tt.count))
+			if tt.invalid == nil {
+				g.Expect(validationErr.Invalid).To(BeEmpty())
+			} else {
+				g.Expect(validationErr.Invalid).To(Equal(tt.invalid))
+			}
+			if tt.err != "" {
+				g.Expect(err).To(MatchError(tt.err))
+			}
+		})
+	}
+}
+
+func TestNewTempFile_TagNormalizationDoesNotModifyTags(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	tags := map[string]string{"team#1": "backend"}
+	file, err := NewTempFile[string](tags, WithTagNormalization())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	g.Expect(file.Tags()).To(Equal(map[string]string{"team_1": "backend"}))
+	g.Expect(tags).To(Equal(map[string]string{"team#1": "backend"}))
+}
+
+func TestTagValidationError_Error(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	err := &TagValidationError{
+		Count: 12,
+		Invalid: []InvalidTag{
+			{Key: "", Value: "", Reason: "key is empty"},
+			{Key: "team#1", Value: "a*", Reason: "key has characters that are not allowed, value has characters that are not allowed"},
+		},
+	}
+	g.Expect(err.Error()).To(Equal(`invalid tags: 12 tags, the limit is 10; tag "": key is empty; ` +
+		`tag "team#1": key has characters that are not allowed, value has characters that are not allowed`))
+}
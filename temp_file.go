@@ -1,11 +1,22 @@
 package s3batchstore
 
 import (
+	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/klauspost/compress/zstd"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -14,86 +25,553 @@ const version string = "v1"
 
 // TempFile creates a temp file in the filesystem, and is used to store the contents that will be uploaded to s3.
 // This way we avoid having all the bytes in memory.
+// The storage can be changed with WithTempDir, WithMemoryStorage or WithTempStorage.
 // This will also keep track of the indexes for each slice of bytes, in order to know where each of them are located
-// TempFile is not thread safe, if you expect to make concurrent calls to Append, you should protect it.
+// TempFile is thread safe, many goroutines can call Append concurrently. The payloads are compressed, encrypted
+// and checksummed outside the file lock, so concurrent appends only contend while writing the bytes to the file.
+// AppendReader reads its payload under the file lock, unless the file was created WithAppendReaderScratch.
 // K represents the type of IDs for the objects that will be uploaded
 type TempFile[K comparable] struct {
+	tempFileOptions
 	fileName  string
-	file      *os.File
+	file      TempStorage
 	createdOn time.Time
 	tags      map[string]string
 
+	dataKey    cipher.AEAD // Used to encrypt the objects, only set when using WithEncryption
+	wrappedKey []byte      // The dataKey wrapped by the KeyProvider
+
+	mu       sync.RWMutex // Protects the fields below
 	readonly bool
 	count    uint   // How many items are currently saved in the file
 	offset   uint64 // The current offset in the file
 	indexes  map[K]ObjectIndex
+
+	duplicates  uint                // How many appends used an id that was already in the file
+	wastedBytes uint64              // Bytes of the objects that were overwritten by a duplicate
+	versions    map[K][]ObjectIndex // Previous versions of the duplicated objects, only with DuplicateKeepAll
+
+	journal      *journal    // Records the appended objects to recover the file after a crash, only set when using WithJournal
+	journalCodec KeyCodec[K] // Encodes the ids in the journal, only set when using WithJournal
 }
 
 type ObjectIndex struct {
-	File   string `json:"file"`
-	Offset uint64 `json:"offset"`
-	Length uint64 `json:"length"`
+	File   string  `json:"file"`
+	Offset uint64  `json:"offset"`
+	Length uint64  `json:"length"`
+	CRC32C *uint32 `json:"crc32c,omitempty"` // Checksum of the stored bytes, only set when using WithChecksums
+
+	Codec              Codec  `json:"codec,omitempty"`               // How the stored bytes are compressed, if they are
+	UncompressedLength uint64 `json:"uncompressed_length,omitempty"` // Length of the payload before compressing it
+
+	Encryption string `json:"encryption,omitempty"`  // How the stored bytes are encrypted, if they are
+	WrappedKey []byte `json:"wrapped_key,omitempty"` // The data key used to encrypt the object, wrapped by the KeyProvider
+
+	Attributes *ObjectAttributes `json:"attributes,omitempty"` // Provided when appending the object, if any
+}
+
+// TempFileOption allows to customize the behaviour of a TempFile.
+type TempFileOption func(*tempFileOptions)
+
+// tempFileOptions holds the optional settings of a TempFile. The zero value is a valid configuration.
+type tempFileOptions struct {
+	checksums bool  // Whether to compute a checksum of each object
+	codec     Codec // How to compress each object
+
+	keyProvider    KeyProvider   // Provides the data key to encrypt the objects, if set
+	dataKeyTimeout time.Duration // Timeout to generate the data key, defaultDataKeyTimeout if not set
+
+	duplicatePolicy DuplicatePolicy // What to do when the same id is appended twice
+
+	keyStrategy KeyStrategy // Decides the s3 key of the file, defaultKeyStrategy if not set
+
+	storageFactory TempStorageFactory // Creates the storage of the file contents, a file in os.TempDir() if not set
+
+	journal         bool              // Whether to keep a journal of the appended objects
+	journalSync     JournalSyncPolicy // When to flush the journal to disk
+	journalKeyCodec any               // The KeyCodec[K] of the ids in the journal, the default one for K if not set
+
+	normalizeTags bool // Whether to sanitize the tags instead of rejecting the invalid ones
+
+	appendReaderScratch bool // Whether AppendReader copies the payload to a scratch storage before taking the lock
+}
+
+// DuplicatePolicy defines what a TempFile does when an object is appended with an id that is already in the file.
+type DuplicatePolicy int
+
+const (
+	// DuplicateKeepLast appends the new object, and replaces the index of the previous one, whose bytes are
+	// wasted in the file. This is the default.
+	DuplicateKeepLast DuplicatePolicy = iota
+	// DuplicateKeepFirst ignores the new object, without appending it, and returns the index of the previous one.
+	DuplicateKeepFirst
+	// DuplicateReject returns a *DuplicateIDError, without appending the new object.
+	DuplicateReject
+	// DuplicateKeepAll appends the new object, and keeps the index of the previous one as an older version of the
+	// object, available through Versions. Indexes only returns the latest version of each object. The older versions
+	// are stored in the MetaFileV2 meta files and in the footer index, and reported in BatchResult.Versions.
+	DuplicateKeepAll
+)
+
+// WithDuplicatePolicy sets what the TempFile does when an object is appended with an id that is already in the file.
+// Defaults to DuplicateKeepLast.
+func WithDuplicatePolicy(policy DuplicatePolicy) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.duplicatePolicy = policy
+	}
+}
+
+// WithChecksums makes the TempFile compute a CRC32C checksum of each appended object and store it in its ObjectIndex.
+// When an object has a checksum, Fetch verifies it and returns a *CorruptionError if the downloaded bytes don't match,
+// which helps to detect indexes that point to the wrong bytes.
+func WithChecksums() TempFileOption {
+	return func(o *tempFileOptions) {
+		o.checksums = true
+	}
 }
 
-func (c *client[K]) NewTempFile(tags map[string]string) (*TempFile[K], error) {
-	return NewTempFile[K](tags)
+// WithCompression makes the TempFile compress each appended object with the given codec.
+// The codec and the uncompressed length are stored in the ObjectIndex, and Fetch decompresses the payload
+// automatically, so callers always deal with the original bytes.
+func WithCompression(codec Codec) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.codec = codec
+	}
+}
+
+// WithEncryption makes the TempFile encrypt each appended object with AES-GCM (see EncryptionAES256GCM), using a
+// data key generated by the KeyProvider when the file is created. The wrapped data key is stored in the ObjectIndex,
+// so the client used to fetch the objects must be configured with a KeyProvider able to unwrap it (WithKeyProvider).
+// Objects are compressed before being encrypted.
+// Each object is encrypted as a whole, so AppendReader buffers the entire payload in memory for encrypted files.
+// The data key is generated by NewTempFile, with the timeout set with WithDataKeyTimeout.
+func WithEncryption(keyProvider KeyProvider) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.keyProvider = keyProvider
+	}
 }
 
-func NewTempFile[K comparable](tags map[string]string) (*TempFile[K], error) {
-	fileName := ulid.Make().String()
+// WithDataKeyTimeout sets the timeout for the KeyProvider to generate the data key of a file created with
+// WithEncryption, which may involve a call to a KMS. Defaults to 30 seconds.
+func WithDataKeyTimeout(timeout time.Duration) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.dataKeyTimeout = timeout
+	}
+}
+
+// defaultDataKeyTimeout is the default timeout to generate the data key of an encrypted file
+const defaultDataKeyTimeout = 30 * time.Second
+
+// WithKeyStrategy sets how the s3 key of the file is built. Defaults to v1/yyyy/mm/dd/hh/ULID.
+// See NewKeyStrategy for the built-in layouts.
+func WithKeyStrategy(strategy KeyStrategy) TempFileOption {
+	return func(o *tempFileOptions) {
+		o.keyStrategy = strategy
+	}
+}
+
+// WithAppendReaderScratch makes AppendReader copy the payload to a scratch storage before taking the file lock, so
+// a slow reader doesn't stall the concurrent appends. The stored bytes are then copied into the file, which needs
+// as much temporary space again as the payload. Scratch files are created next to the temp file, and the ones left
+// behind by a crash are deleted by RecoverTempFiles.
+func WithAppendReaderScratch() TempFileOption {
+	return func(o *tempFileOptions) {
+		o.appendReaderScratch = true
+	}
+}
 
-	file, err := os.CreateTemp(os.TempDir(), fileName)
+func (c *client[K]) NewTempFile(tags map[string]string, opts ...TempFileOption) (*TempFile[K], error) {
+	// The journal stores the ids with the codec of the client, unless the options set a different one
+	fileOpts := []TempFileOption{func(o *tempFileOptions) { o.journalKeyCodec = c.idCodec }}
+	fileOpts = append(fileOpts, c.tempFileOpts...)
+	return NewTempFile[K](tags, append(fileOpts, opts...)...)
+}
+
+func NewTempFile[K comparable](tags map[string]string, opts ...TempFileOption) (*TempFile[K], error) {
+	var options tempFileOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if !options.codec.valid() {
+		return nil, fmt.Errorf("unsupported codec %q", options.codec)
+	}
+
+	// Validate the tags now, instead of failing when uploading the file
+	var invalidTags []InvalidTag
+	if options.normalizeTags {
+		tags, invalidTags = normalizeTags(tags)
+	}
+	if err := validateTags(tags, invalidTags); err != nil {
+		return nil, err
+	}
+
+	var dataKey cipher.AEAD
+	var wrappedKey []byte
+	if options.keyProvider != nil {
+		timeout := options.dataKeyTimeout
+		if timeout <= 0 {
+			timeout = defaultDataKeyTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		plaintext, wrapped, err := options.keyProvider.GenerateDataKey(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate data key: %w", err)
+		}
+		if dataKey, err = newAEAD(plaintext); err != nil {
+			return nil, fmt.Errorf("invalid data key: %w", err)
+		}
+		wrappedKey = wrapped
+	}
+
+	keyStrategy := options.keyStrategy
+	if keyStrategy == nil {
+		keyStrategy = defaultKeyStrategy
+	}
+	fileID := ulid.Make().String()
+	createdOn := time.Now()
+	fileName := keyStrategy.FileKey(FileKeyInput{ID: fileID, CreatedOn: createdOn, Tags: tags})
+	if fileName == "" {
+		return nil, errors.New("the key strategy returned an empty file key")
+	}
+
+	var file TempStorage
+	var err error
+	if options.storageFactory != nil {
+		file, err = options.storageFactory(fileID)
+	} else {
+		file, err = newDiskStorage(os.TempDir(), fileID)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	var fileJournal *journal
+	var journalCodec KeyCodec[K]
+	if options.journal {
+		disk, ok := file.(*diskStorage)
+		if !ok {
+			_ = file.Close()
+			return nil, errors.New("the journal is only supported when storing the file contents in a file")
+		}
+		if journalCodec, err = resolveKeyCodec[K](options.journalKeyCodec); err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to create journal: %w", err)
+		}
+		header := journalHeader{FileKey: fileName, CreatedOn: createdOn, Tags: tags, DuplicatePolicy: options.duplicatePolicy}
+		if fileJournal, err = newJournal(disk.File, header, options.journalSync); err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to create journal: %w", err)
+		}
+	}
+
 	return &TempFile[K]{
-		fileName:  version + "/" + timeToFilePath(time.Now()) + "/" + fileName,
-		file:      file,
-		createdOn: time.Now(),
-		tags:      tags,
-		indexes:   map[K]ObjectIndex{},
+		tempFileOptions: options,
+		fileName:        fileName,
+		file:            file,
+		createdOn:       createdOn,
+		tags:            tags,
+		dataKey:         dataKey,
+		wrappedKey:      wrappedKey,
+		indexes:         map[K]ObjectIndex{},
+		journal:         fileJournal,
+		journalCodec:    journalCodec,
 	}, nil
 }
 
 // Append is the same as AppendAndReturnIndex but doesn't return an index. This method could be deleted, but
 // it is kept for backwards compatibility.
-func (f *TempFile[K]) Append(id K, bytes []byte) error {
-	_, err := f.AppendAndReturnIndex(id, bytes)
+func (f *TempFile[K]) Append(id K, bytes []byte, opts ...AppendOption) error {
+	_, err := f.AppendAndReturnIndex(id, bytes, opts...)
 	return err
 }
 
 // AppendAndReturnIndex will take an id, and the slice of bytes of the Object, and append it to the temp file.
 // This will also return the associated ObjectIndex information for this slice of bytes, which tells
 // where the object is located in this file (file, offset, length)
-// This method is not thread safe, if you expect to make concurrent calls to Append, you should protect it.
-// If you provide the same id twice, the second call will overwrite the first one, but the file will still grow in size.
-func (f *TempFile[K]) AppendAndReturnIndex(id K, bytes []byte) (ObjectIndex, error) {
+// This method is thread safe.
+// If you provide the same id twice, the behaviour depends on the DuplicatePolicy of the file. By default, the second
+// call will overwrite the first one, but the file will still grow in size.
+// opts can be used to store attributes of the object in its index, like its content type (see ObjectAttributes).
+func (f *TempFile[K]) AppendAndReturnIndex(id K, bytes []byte, opts ...AppendOption) (ObjectIndex, error) {
+	// Compress and encrypt the payload if needed, and compute its checksum, before taking the lock
+	stored, index, err := f.encodeObject(bytes)
+	if err != nil {
+		return ObjectIndex{}, err
+	}
+	index.Attributes = objectAttributes(opts)
+	length := uint64(len(stored))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	if f.readonly {
 		return ObjectIndex{}, fmt.Errorf("file %s is readonly", f.fileName)
 	}
-
-	length := uint64(len(bytes))
+	if existing, skip, err := f.checkDuplicateLocked(id); skip || err != nil {
+		return existing, err
+	}
 
 	// Append to file
-	bytesWritten, err := f.file.Write(bytes)
+	bytesWritten, err := f.file.Write(stored)
 	if err != nil {
+		// Discard anything that was written, so the next object starts at the current offset
+		if truncateErr := f.truncateLocked(); truncateErr != nil {
+			err = errors.Join(err, truncateErr)
+		}
 		return ObjectIndex{}, fmt.Errorf("failed to write %d bytes (%d written) to file %s: %w", length, bytesWritten, f.file.Name(), err)
 	}
 
-	// Add index
-	index := ObjectIndex{
-		File:   f.fileName,
-		Offset: f.offset,
-		Length: length,
+	return f.commitLocked(id, index, length)
+}
+
+// AppendReader is the same as AppendAndReturnIndex, but it copies the payload from r straight into the temp file
+// until EOF, without buffering it in memory. The payload is compressed and checksummed while it is copied.
+// Encrypted files are the exception, as objects are encrypted as a whole, so the payload is buffered in memory.
+// The file lock is held while reading r, so a slow reader stalls the concurrent appends, unless the file was created
+// WithAppendReaderScratch.
+// If reading or writing fails, the partially written bytes are discarded.
+func (f *TempFile[K]) AppendReader(id K, r io.Reader, opts ...AppendOption) (ObjectIndex, error) {
+	if f.dataKey != nil {
+		payload, err := io.ReadAll(r)
+		if err != nil {
+			return ObjectIndex{}, fmt.Errorf("failed to read object: %w", err)
+		}
+		return f.AppendAndReturnIndex(id, payload, opts...)
+	}
+	if f.appendReaderScratch {
+		return f.appendFromScratch(id, r, opts)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.readonly {
+		return ObjectIndex{}, fmt.Errorf("file %s is readonly", f.fileName)
+	}
+	if existing, skip, err := f.checkDuplicateLocked(id); skip || err != nil {
+		return existing, err
 	}
+
+	index, length, err := encodeObjectFrom(f.file, r, f.codec, f.checksums)
+	if err != nil {
+		// Discard anything that was written, so the next object starts at the current offset
+		if truncateErr := f.truncateLocked(); truncateErr != nil {
+			err = errors.Join(err, truncateErr)
+		}
+		return ObjectIndex{}, fmt.Errorf("failed to append object to file %s: %w", f.file.Name(), err)
+	}
+	index.Attributes = objectAttributes(opts)
+
+	return f.commitLocked(id, index, length)
+}
+
+// appendFromScratch implements AppendReader for the files created WithAppendReaderScratch. The payload is first
+// copied to a scratch storage without holding the file lock, which is only taken to copy the stored bytes into
+// the file.
+func (f *TempFile[K]) appendFromScratch(id K, r io.Reader, opts []AppendOption) (ObjectIndex, error) {
+	// Fail before consuming the reader if the object can't be appended, this is checked again before writing it
+	if existing, skip, err := f.checkAppend(id); skip || err != nil {
+		return existing, err
+	}
+
+	scratch, err := f.newScratchStorage()
+	if err != nil {
+		return ObjectIndex{}, fmt.Errorf("failed to create scratch storage for file %s: %w", f.fileName, err)
+	}
+	defer func() { _ = scratch.Close() }()
+
+	index, length, err := encodeObjectFrom(scratch, r, f.codec, f.checksums)
+	if err != nil {
+		return ObjectIndex{}, fmt.Errorf("failed to append object to file %s: %w", f.file.Name(), err)
+	}
+	index.Attributes = objectAttributes(opts)
+	if _, err = scratch.Seek(0, io.SeekStart); err != nil {
+		return ObjectIndex{}, fmt.Errorf("failed to append object to file %s: %w", f.file.Name(), err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.readonly {
+		return ObjectIndex{}, fmt.Errorf("file %s is readonly", f.fileName)
+	}
+	if existing, skip, err := f.checkDuplicateLocked(id); skip || err != nil {
+		return existing, err
+	}
+
+	if _, err = io.CopyN(f.file, scratch, int64(length)); err != nil {
+		// Discard anything that was written, so the next object starts at the current offset
+		if truncateErr := f.truncateLocked(); truncateErr != nil {
+			err = errors.Join(err, truncateErr)
+		}
+		return ObjectIndex{}, fmt.Errorf("failed to append object to file %s: %w", f.file.Name(), err)
+	}
+
+	return f.commitLocked(id, index, length)
+}
+
+// checkAppend returns whether an object with the given id must not be appended, along with the index or error to
+// return to the caller, like when the file is readonly.
+func (f *TempFile[K]) checkAppend(id K) (ObjectIndex, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.readonly {
+		return ObjectIndex{}, true, fmt.Errorf("file %s is readonly", f.fileName)
+	}
+	return f.checkDuplicateLocked(id)
+}
+
+// newScratchStorage creates a storage to hold the bytes of an object before appending them to the file, of the
+// same kind as the storage of the file. Scratch files are created next to the file, so RecoverTempFiles can delete
+// the ones left behind by a crash.
+func (f *TempFile[K]) newScratchStorage() (TempStorage, error) {
+	if disk, ok := f.file.(*diskStorage); ok {
+		file, err := os.CreateTemp(filepath.Dir(disk.Name()), filepath.Base(disk.Name())+".*"+scratchSuffix)
+		if err != nil {
+			return nil, err
+		}
+		return &diskStorage{File: file}, nil
+	}
+	return f.storageFactory(ulid.Make().String())
+}
+
+// encodeObjectFrom copies the payload from r to w, compressing it with codec and checksumming it as needed,
+// and returns the index that describes how to decode it, along with the number of bytes written.
+// The location fields of the index are not set.
+func encodeObjectFrom(w io.Writer, r io.Reader, codec Codec, checksums bool) (ObjectIndex, uint64, error) {
+	var index ObjectIndex
+	stored := &countingWriter{w: w}
+	var dst io.Writer = stored
+	var checksum hash.Hash32
+	if checksums {
+		checksum = crc32.New(crc32cTable)
+		dst = io.MultiWriter(stored, checksum)
+	}
+
+	switch codec {
+	case CodecZstd:
+		encoder, err := zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return ObjectIndex{}, 0, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		n, err := io.Copy(encoder, r)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return ObjectIndex{}, 0, err
+		}
+		index.Codec = CodecZstd
+		index.UncompressedLength = uint64(n)
+	default:
+		if _, err := io.Copy(dst, r); err != nil {
+			return ObjectIndex{}, 0, err
+		}
+	}
+
+	if checksum != nil {
+		index.CRC32C = aws.Uint32(checksum.Sum32())
+	}
+	return index, stored.n, nil
+}
+
+// truncateLocked discards any bytes written to the file after the current offset. f.mu must be held.
+func (f *TempFile[K]) truncateLocked() error {
+	if err := f.file.Truncate(int64(f.offset)); err != nil {
+		return err
+	}
+	_, err := f.file.Seek(int64(f.offset), io.SeekStart)
+	return err
+}
+
+// checkDuplicateLocked applies the DuplicatePolicy before appending an object with the given id.
+// It returns true if the object must not be appended, along with the index or error to return to the caller.
+// f.mu must be held.
+func (f *TempFile[K]) checkDuplicateLocked(id K) (ObjectIndex, bool, error) {
+	existing, ok := f.indexes[id]
+	if !ok {
+		return ObjectIndex{}, false, nil
+	}
+
+	switch f.duplicatePolicy {
+	case DuplicateKeepFirst:
+		f.duplicates++
+		return existing, true, nil
+	case DuplicateReject:
+		f.duplicates++
+		return ObjectIndex{}, true, &DuplicateIDError{ID: id, File: f.fileName}
+	default:
+		return ObjectIndex{}, false, nil
+	}
+}
+
+// commitLocked sets the location of an object of the given length that was just written at the current offset,
+// records it in the journal, if the file has one, and stores its index. If the journal can't be written,
+// the object bytes are discarded. f.mu must be held.
+func (f *TempFile[K]) commitLocked(id K, index ObjectIndex, length uint64) (ObjectIndex, error) {
+	index.File = f.fileName
+	index.Offset = f.offset
+	index.Length = length
+
+	if err := f.appendJournalLocked(id, index); err != nil {
+		if truncateErr := f.truncateLocked(); truncateErr != nil {
+			err = errors.Join(err, truncateErr)
+		}
+		return ObjectIndex{}, fmt.Errorf("failed to write the journal of file %s: %w", f.file.Name(), err)
+	}
+
+	return f.addIndexLocked(id, index), nil
+}
+
+// appendJournalLocked records the index of an object in the journal, if the file has one. f.mu must be held.
+func (f *TempFile[K]) appendJournalLocked(id K, index ObjectIndex) error {
+	if f.journal == nil {
+		return nil
+	}
+	key, err := f.journalCodec.EncodeKey(id)
+	if err != nil {
+		return fmt.Errorf("failed to encode id %v: %w", id, err)
+	}
+	return f.journal.append(key, index)
+}
+
+// addIndexLocked stores the index of an object that was just written at the current offset, and updates the
+// counters. f.mu must be held.
+func (f *TempFile[K]) addIndexLocked(id K, index ObjectIndex) ObjectIndex {
+	if previous, ok := f.indexes[id]; ok {
+		f.duplicates++
+		if f.duplicatePolicy == DuplicateKeepAll {
+			if f.versions == nil {
+				f.versions = map[K][]ObjectIndex{}
+			}
+			f.versions[id] = append(f.versions[id], previous)
+		} else {
+			f.wastedBytes += previous.Length
+		}
+	}
+
+	// Add index
 	f.indexes[id] = index
 
 	// Increment counters/metrics
 	f.count++
-	f.offset += length
+	f.offset += index.Length
 
-	return index, nil
+	return index
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += uint64(n)
+	return n, err
 }
 
 // Name returns the fileName
@@ -113,33 +591,87 @@ func (f *TempFile[K]) Age() time.Duration {
 
 // Count returns the number of items stored in this file
 func (f *TempFile[K]) Count() uint {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.count
 }
 
 // Size returns the size of the file contents in bytes
 func (f *TempFile[K]) Size() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.offset
 }
 
-// Indexes returns the indexes that the file is holding
+// Indexes returns a snapshot of the indexes that the file is holding, which is consistent with Count and Size
+// at the time of the call.
 func (f *TempFile[K]) Indexes() map[K]ObjectIndex {
-	return f.indexes
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return maps.Clone(f.indexes)
+}
+
+// Duplicates returns how many times an object was appended with an id that was already in the file
+func (f *TempFile[K]) Duplicates() uint {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.duplicates
+}
+
+// WastedBytes returns how many bytes of the file belong to objects that were overwritten by a duplicate,
+// and are no longer referenced by any index
+func (f *TempFile[K]) WastedBytes() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.wastedBytes
+}
+
+// Versions returns all the indexes stored for the given id, from the oldest to the latest one.
+// Older versions are only kept with DuplicateKeepAll, see MetaFile.Versions to read them after the upload.
+func (f *TempFile[K]) Versions(id K) []ObjectIndex {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	latest, ok := f.indexes[id]
+	if !ok {
+		return nil
+	}
+	return append(slices.Clone(f.versions[id]), latest)
+}
+
+// olderVersions returns a snapshot of the older versions of the objects appended more than once with
+// DuplicateKeepAll, or nil if there are none.
+func (f *TempFile[K]) olderVersions() map[K][]ObjectIndex {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.versions) == 0 {
+		return nil
+	}
+	versions := make(map[K][]ObjectIndex, len(f.versions))
+	for id, indexes := range f.versions {
+		versions[id] = slices.Clone(indexes)
+	}
+	return versions
 }
 
 // Close will delete the file, as it is no longer needed, and given that these files may be really large,
 // we want to avoid having then live in the os for a long period of time.
 func (f *TempFile[K]) Close() error {
 	// This is a temp file, so on Close we delete it.
-	return os.Remove(f.file.Name())
+	// The journal goes first, so that a crash in between can't leave a journal without its data file.
+	journalErr := f.journal.remove()
+	return errors.Join(f.file.Close(), journalErr)
 }
 
 // MetaFileKey  returns the key to be used for the json meta file
 func (f *TempFile[K]) MetaFileKey() string {
-	return f.fileName + ".meta.json.zst"
+	return metaFileKey(f.fileName)
 }
 
-// readOnly logically closes the file by not accepting more appends, and returns the os.File used to upload the file to s3
-func (f *TempFile[K]) readOnly() (*os.File, error) {
+// readOnly logically closes the file by not accepting more appends, and returns the storage used to upload the file to s3
+func (f *TempFile[K]) readOnly() (TempStorage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	// Set file pointer to beginning
 	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
 		return nil, err
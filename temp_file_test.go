@@ -3,13 +3,24 @@ package s3batchstore
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	mocks3 "github.com/embrace-io/s3-batch-object-store/mock/aws"
 	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
 )
 
 const testBucketName = "test-bucket"
@@ -21,7 +32,7 @@ var testTags = map[string]string{
 func TestFile_Append(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	c := client[string]{}
+	c := client[string]{idCodec: StringKeyCodec[string]()}
 
 	file, err := c.NewTempFile(testTags)
 	g.Expect(err).ToNot(HaveOccurred())
@@ -50,10 +61,310 @@ func TestFile_Append(t *testing.T) {
 	g.Expect(file.Indexes()[obj2.ID].Length).To(BeNumerically(">", 0))
 }
 
+func TestFile_AppendWithChecksums(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	c := client[string]{
+		idCodec:       StringKeyCodec[string](),
+		clientOptions: clientOptions{tempFileOpts: []TempFileOption{WithChecksums()}},
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	index, err := file.AppendAndReturnIndex("1", []byte("123456789"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.CRC32C).ToNot(BeNil())
+	g.Expect(*index.CRC32C).To(Equal(uint32(0xe3069283))) // Standard CRC32C check value
+
+	// Without the option, no checksum is computed
+	file2, err := NewTempFile[string](testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file2.Close() }()
+
+	index, err = file2.AppendAndReturnIndex("1", []byte("123456789"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.CRC32C).To(BeNil())
+}
+
+func TestFile_ConcurrentAppend(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	file, err := NewTempFile[string](testTags, WithChecksums())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	const goroutines, appends = 8, 50
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		wg.Go(func() {
+			for j := range appends {
+				id := fmt.Sprintf("%d-%d", i, j)
+				_, err := file.AppendAndReturnIndex(id, []byte("payload "+id))
+				g.Expect(err).ToNot(HaveOccurred())
+				// Reading while others are appending is safe
+				_ = file.Count()
+				_ = file.Size()
+			}
+		})
+	}
+	wg.Wait()
+
+	indexes := file.Indexes()
+	g.Expect(indexes).To(HaveLen(goroutines * appends))
+	g.Expect(file.Count()).To(Equal(uint(goroutines * appends)))
+
+	// Every object is stored in its own range, and the ranges cover the whole file
+	contents := tempFileContents(g, file)
+	g.Expect(uint64(len(contents))).To(Equal(file.Size()))
+	var total uint64
+	for id, ind := range indexes {
+		g.Expect(string(contents[ind.Offset : ind.Offset+ind.Length])).To(Equal("payload " + id))
+		total += ind.Length
+	}
+	g.Expect(total).To(Equal(file.Size()))
+}
+
+func TestFile_AppendReader(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	file, err := NewTempFile[string](testTags, WithChecksums())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	index1, err := file.AppendReader("1", strings.NewReader("my first payload"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index1.Offset).To(Equal(uint64(0)))
+	g.Expect(index1.Length).To(Equal(uint64(len("my first payload"))))
+	g.Expect(*index1.CRC32C).To(Equal(crc32.Checksum([]byte("my first payload"), crc32cTable)))
+
+	// A failing reader doesn't leave any bytes behind
+	_, err = file.AppendReader("2", io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("read error"))))
+	g.Expect(err).To(MatchError(fmt.Sprintf("failed to append object to file %s: read error", file.file.Name())))
+	g.Expect(file.Indexes()).ToNot(HaveKey("2"))
+	g.Expect(file.Count()).To(Equal(uint(1)))
+
+	index3, err := file.AppendReader("3", strings.NewReader("my third payload"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index3.Offset).To(Equal(index1.Length))
+	g.Expect(string(tempFileContents(g, file))).To(Equal("my first payloadmy third payload"))
+
+	_, err = file.readOnly()
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = file.AppendReader("4", strings.NewReader("my fourth payload"))
+	g.Expect(err).To(MatchError(fmt.Sprintf("file %s is readonly", file.fileName)))
+}
+
+func TestFile_AppendReaderSlowReader(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	file, err := NewTempFile[string](testTags, WithMemoryStorage(), WithAppendReaderScratch())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	// A reader that is still being written doesn't hold the file lock, so other appends can go first
+	pr, pw := io.Pipe()
+	appended := make(chan error)
+	go func() {
+		_, err := file.AppendReader("1", pr)
+		appended <- err
+	}()
+	_, err = pw.Write([]byte("my slow "))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(file.Append("2", []byte("my second payload"))).To(Succeed())
+	_, err = pw.Write([]byte("payload"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pw.Close()).To(Succeed())
+	g.Expect(<-appended).To(Succeed())
+
+	g.Expect(string(tempFileContents(g, file))).To(Equal("my second payloadmy slow payload"))
+	g.Expect(file.Indexes()["1"].Offset).To(Equal(uint64(len("my second payload"))))
+}
+
+func TestFile_AppendReaderScratchFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	dir := t.TempDir()
+
+	file, err := NewTempFile[string](testTags, WithTempDir(dir), WithAppendReaderScratch())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+
+	// The payload is copied to a scratch file next to the temp file, which is deleted once appended
+	pr, pw := io.Pipe()
+	appended := make(chan error)
+	go func() {
+		_, err := file.AppendReader("1", pr)
+		appended <- err
+	}()
+	_, err = pw.Write([]byte("my first payload"))
+	g.Expect(err).ToNot(HaveOccurred())
+	scratchFiles, err := filepath.Glob(filepath.Join(dir, filepath.Base(file.file.Name())+".*"+scratchSuffix))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(scratchFiles).To(HaveLen(1))
+	g.Expect(pw.Close()).To(Succeed())
+	g.Expect(<-appended).To(Succeed())
+
+	g.Expect(scratchFiles[0]).ToNot(BeAnExistingFile())
+	g.Expect(string(tempFileContents(g, file))).To(Equal("my first payload"))
+}
+
+func TestFile_AppendReaderEncoded(t *testing.T) {
+	kp, err := NewStaticKeyProvider(testMasterKey)
+	NewGomegaWithT(t).Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		name string
+		opts []TempFileOption
+	}{
+		{name: "compressed", opts: []TempFileOption{WithCompression(CodecZstd), WithChecksums()}},
+		{name: "encrypted", opts: []TempFileOption{WithCompression(CodecZstd), WithEncryption(kp), WithChecksums()}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			ctx := context.Background()
+
+			file, err := NewTempFile[string](testTags, test.opts...)
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+
+			payload := bytes.Repeat([]byte("my payload "), 1000)
+			index, err := file.AppendReader("1", bytes.NewReader(payload))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(index.Codec).To(Equal(CodecZstd))
+			g.Expect(index.UncompressedLength).To(Equal(uint64(len(payload))))
+			g.Expect(index.Length).To(Equal(file.Size()))
+			contents := tempFileContents(g, file)
+
+			ctrl := gomock.NewController(t)
+			s3Mock := mocks3.NewMockS3Client(ctrl)
+			s3Mock.EXPECT().GetObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.GetObjectInput, _ ...func(options *s3.Options)) (*s3.GetObjectOutput, error) {
+				return getObjectFromBytes(g, contents, input)
+			})
+
+			c := client[string]{
+				idCodec:       StringKeyCodec[string](),
+				clientOptions: clientOptions{keyProvider: kp},
+				s3Bucket:      testBucketName,
+				s3Client:      s3Mock,
+			}
+			b, err := c.Fetch(ctx, index)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(b).To(Equal(payload))
+		})
+	}
+}
+
+func TestFile_DuplicatePolicy(t *testing.T) {
+	first, second := []byte("first"), []byte("second version")
+
+	tests := []struct {
+		name             string
+		policy           DuplicatePolicy
+		err              interface{}
+		expectedPayload  string
+		expectedCount    uint
+		expectedWasted   uint64
+		expectedVersions int
+	}{
+		{
+			name:             "keep last",
+			policy:           DuplicateKeepLast,
+			expectedPayload:  "second version",
+			expectedCount:    2,
+			expectedWasted:   uint64(len(first)),
+			expectedVersions: 1,
+		},
+		{
+			name:             "keep first",
+			policy:           DuplicateKeepFirst,
+			expectedPayload:  "first",
+			expectedCount:    1,
+			expectedVersions: 1,
+		},
+		{
+			name:             "reject",
+			policy:           DuplicateReject,
+			err:              ErrDuplicateID,
+			expectedPayload:  "first",
+			expectedCount:    1,
+			expectedVersions: 1,
+		},
+		{
+			name:             "keep all",
+			policy:           DuplicateKeepAll,
+			expectedPayload:  "second version",
+			expectedCount:    2,
+			expectedVersions: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+
+			file, err := NewTempFile[string](testTags, WithDuplicatePolicy(test.policy))
+			g.Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = file.Close() }()
+
+			firstIndex, err := file.AppendAndReturnIndex("1", first)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			index, err := file.AppendReader("1", bytes.NewReader(second))
+			if test.err == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(index).To(Equal(file.Indexes()["1"]))
+			} else {
+				g.Expect(err).To(MatchError(test.err))
+				g.Expect(index).To(Equal(ObjectIndex{}))
+			}
+
+			contents := tempFileContents(g, file)
+			latest := file.Indexes()["1"]
+			g.Expect(string(contents[latest.Offset : latest.Offset+latest.Length])).To(Equal(test.expectedPayload))
+			g.Expect(file.Count()).To(Equal(test.expectedCount))
+			g.Expect(file.Duplicates()).To(Equal(uint(1)))
+			g.Expect(file.WastedBytes()).To(Equal(test.expectedWasted))
+
+			versions := file.Versions("1")
+			g.Expect(versions).To(HaveLen(test.expectedVersions))
+			g.Expect(versions[len(versions)-1]).To(Equal(latest))
+			if test.policy != DuplicateKeepLast {
+				// The first object is still referenced
+				g.Expect(versions[0]).To(Equal(firstIndex))
+			}
+			g.Expect(file.Versions("2")).To(BeNil())
+		})
+	}
+}
+
+func TestDuplicateIDError(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	err := fmt.Errorf("wrapped: %w", &DuplicateIDError{ID: 42, File: "my-file"})
+	g.Expect(err).To(MatchError("wrapped: duplicate object id: id 42 is already in file my-file"))
+	g.Expect(errors.Is(err, ErrDuplicateID)).To(BeTrue())
+
+	var duplicateErr *DuplicateIDError
+	g.Expect(errors.As(err, &duplicateErr)).To(BeTrue())
+	g.Expect(duplicateErr.ID).To(Equal(42))
+}
+
+func TestNewTempFile_UnsupportedCodec(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	file, err := NewTempFile[string](testTags, WithCompression("lz4"))
+	g.Expect(err).To(MatchError(`unsupported codec "lz4"`))
+	g.Expect(file).To(BeNil())
+}
+
 func TestFile_WriteError(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	c := client[string]{}
+	c := client[string]{idCodec: StringKeyCodec[string]()}
 
 	file, err := c.NewTempFile(testTags)
 	g.Expect(err).ToNot(HaveOccurred())
@@ -80,15 +391,56 @@ func TestFile_WriteError(t *testing.T) {
 
 	index, err = file.AppendAndReturnIndex(obj.ID, compressed)
 	fileName := file.file.Name()
-	g.Expect(err).To(MatchError(fmt.Sprintf("failed to write %d bytes (0 written) to file %s: write %s: file already closed", len(compressed), fileName, fileName)))
+	g.Expect(err).To(MatchError(fmt.Sprintf("failed to write %d bytes (0 written) to file %s: write %s: file already closed\n"+
+		"truncate %s: file already closed", len(compressed), fileName, fileName, fileName)))
 	g.Expect(index).To(Equal(ObjectIndex{}))
 	g.Expect(file.Indexes()[obj.ID]).To(Equal(index))
 }
 
+// shortWriteStorage is a TempStorage that only writes half of the bytes, and fails, while short is set.
+type shortWriteStorage struct {
+	TempStorage
+	short bool
+}
+
+func (s *shortWriteStorage) Write(p []byte) (int, error) {
+	if !s.short {
+		return s.TempStorage.Write(p)
+	}
+	n, err := s.TempStorage.Write(p[:len(p)/2])
+	if err == nil {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func TestFile_ShortWrite(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	storage := &shortWriteStorage{TempStorage: &memoryStorage{name: "short"}}
+	file, err := NewTempFile[string](testTags, WithTempStorage(func(string) (TempStorage, error) { return storage, nil }))
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("my first payload"))).To(Succeed())
+
+	// The partially written bytes are discarded
+	storage.short = true
+	err = file.Append("2", []byte("my second payload"))
+	g.Expect(err).To(MatchError("failed to write 17 bytes (8 written) to file short: short write"))
+	g.Expect(file.Indexes()).ToNot(HaveKey("2"))
+
+	// So the next object starts right after the previous one
+	storage.short = false
+	index, err := file.AppendAndReturnIndex("3", []byte("my third payload"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(index.Offset).To(Equal(uint64(len("my first payload"))))
+	g.Expect(string(tempFileContents(g, file))).To(Equal("my first payloadmy third payload"))
+}
+
 func TestFile_ReadOnly(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	c := client[string]{}
+	c := client[string]{idCodec: StringKeyCodec[string]()}
 
 	file, err := c.NewTempFile(testTags)
 	g.Expect(err).ToNot(HaveOccurred())
@@ -123,7 +475,7 @@ func TestFile_ReadOnly(t *testing.T) {
 func TestFile_ReadOnlyError(t *testing.T) {
 	g := NewGomegaWithT(t)
 
-	c := client[string]{}
+	c := client[string]{idCodec: StringKeyCodec[string]()}
 
 	file, err := c.NewTempFile(testTags)
 	g.Expect(err).ToNot(HaveOccurred())
@@ -153,6 +505,13 @@ func TestTimeToFilePath(t *testing.T) {
 	g.Expect(timeToFilePath(tt)).To(Equal("2021/10/08/02"))
 }
 
+// tempFileContents returns all the bytes written to the temp file.
+func tempFileContents[K comparable](g *WithT, file *TempFile[K]) []byte {
+	contents, err := io.ReadAll(io.NewSectionReader(file.file, 0, math.MaxInt64))
+	g.Expect(err).ToNot(HaveOccurred())
+	return contents
+}
+
 // TestObject represents a document that may be uploaded to s3 and fetched from s3
 type TestObject struct {
 	ID    string `json:"id"`
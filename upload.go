@@ -3,67 +3,234 @@ package s3batchstore
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
+	"slices"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/klauspost/compress/zstd"
 )
 
-func (c *client[K]) UploadFile(ctx context.Context, file *TempFile[K], withMetaFile bool) error {
+// UploadOption allows to customize how a file is uploaded by UploadFile.
+type UploadOption func(*uploadOptions)
+
+// uploadOptions holds the optional settings of an upload. The zero value is a valid configuration.
+type uploadOptions struct {
+	serverSideEncryption types.ServerSideEncryption
+	sseKMSKeyID          string
+	bucketKeyEnabled     bool
+	storageClass         types.StorageClass
+	cacheControl         string
+	contentType          string
+	metadata             map[string]string
+	checksumAlgorithm    types.ChecksumAlgorithm
+	noOverwrite          bool // Whether to use conditional writes to never replace existing files
+	rollback             bool // Whether to delete the data file if the meta file upload fails
+	metaFileVersion      int  // The format of the meta file, defaults to the current version
+	footerIndex          bool // Whether to append the index to the data file
+
+	multipartThreshold int64 // Size above which the data file is uploaded in parts
+	partSize           int64
+	uploadConcurrency  int
+}
+
+// WithSSES3 makes s3 encrypt the uploaded files with s3 managed keys (SSE-S3).
+// It can't be used by clients configured with WithSSECustomerKey.
+func WithSSES3() UploadOption {
+	return func(o *uploadOptions) {
+		o.serverSideEncryption = types.ServerSideEncryptionAes256
+		o.sseKMSKeyID = ""
+		o.bucketKeyEnabled = false
+	}
+}
+
+// WithSSEKMS makes s3 encrypt the uploaded files with a KMS key (SSE-KMS).
+// keyID can be empty to use the AWS managed key, and bucketKeyEnabled enables the s3 bucket key to reduce KMS costs.
+// It can't be used by clients configured with WithSSECustomerKey.
+func WithSSEKMS(keyID string, bucketKeyEnabled bool) UploadOption {
+	return func(o *uploadOptions) {
+		o.serverSideEncryption = types.ServerSideEncryptionAwsKms
+		o.sseKMSKeyID = keyID
+		o.bucketKeyEnabled = bucketKeyEnabled
+	}
+}
+
+// WithStorageClass sets the s3 storage class of the uploaded files.
+func WithStorageClass(storageClass types.StorageClass) UploadOption {
+	return func(o *uploadOptions) {
+		o.storageClass = storageClass
+	}
+}
+
+// WithCacheControl sets the Cache-Control header of the uploaded files.
+func WithCacheControl(cacheControl string) UploadOption {
+	return func(o *uploadOptions) {
+		o.cacheControl = cacheControl
+	}
+}
+
+// WithContentType sets the Content-Type of the data file. It is not applied to the meta file.
+func WithContentType(contentType string) UploadOption {
+	return func(o *uploadOptions) {
+		o.contentType = contentType
+	}
+}
+
+// WithMetadata sets the s3 user-defined metadata (x-amz-meta-*) of the uploaded files.
+func WithMetadata(metadata map[string]string) UploadOption {
+	return func(o *uploadOptions) {
+		o.metadata = metadata
+	}
+}
+
+// applyToPut sets the upload options that are common to the data and the meta files in the s3 request.
+func (o *uploadOptions) applyToPut(input *s3.PutObjectInput) {
+	input.ServerSideEncryption = o.serverSideEncryption
+	if o.sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(o.sseKMSKeyID)
+	}
+	if o.bucketKeyEnabled {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+	input.StorageClass = o.storageClass
+	if o.cacheControl != "" {
+		input.CacheControl = aws.String(o.cacheControl)
+	}
+	input.Metadata = o.metadata
+}
+
+func (c *client[K]) UploadFile(ctx context.Context, file *TempFile[K], withMetaFile bool, opts ...UploadOption) error {
+	var options uploadOptions
+	for _, opt := range append(slices.Clip(c.uploadOpts), opts...) {
+		opt(&options)
+	}
+	if options.noOverwrite && options.checksumAlgorithm == "" {
+		// The checksum is needed to know if an existing file is the same one
+		options.checksumAlgorithm = types.ChecksumAlgorithmCrc32c
+	}
+	if options.serverSideEncryption != "" && c.sseCustomerKey != nil {
+		// s3 would reject the request, but only after receiving the whole file
+		return fmt.Errorf("server side encryption %s can't be combined with a customer provided key (SSE-C)", options.serverSideEncryption)
+	}
+	if options.metaFileVersion == 0 {
+		options.metaFileVersion = currentMetaFileVersion
+	} else if options.metaFileVersion != MetaFileV1 && options.metaFileVersion != MetaFileV2 {
+		// Fail before uploading the data file, instead of leaving it without a meta file
+		return fmt.Errorf("unsupported meta file version %d", options.metaFileVersion)
+	}
+
 	body, err := file.readOnly()
 	if err != nil {
 		return fmt.Errorf("failed to get the readonly file: %w", err)
 	}
 
 	tagging := serializeTags(file.Tags())
-	_, err = c.s3Client.PutObject(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket:  &c.s3Bucket,
 		Key:     &file.fileName,
 		Body:    body,
 		Tagging: &tagging,
-	})
+	}
+	options.applyToPut(input)
+	options.applyConditionalWrite(input)
+	if options.contentType != "" {
+		input.ContentType = aws.String(options.contentType)
+	}
+	c.sseCustomerKey.applyToPut(input)
+	size := int64(file.Size())
+	var data io.ReaderAt = body
+	if options.footerIndex {
+		footer, err := encodeFooter(file, c.idCodec)
+		if err != nil {
+			return fmt.Errorf("failed to encode the footer index: %w", err)
+		}
+		data = &footerReaderAt{data: body, size: size, footer: footer}
+		size += int64(len(footer))
+		input.Body = io.NewSectionReader(data, 0, size)
+	}
+	var fileChecksum string
+	if options.checksumAlgorithm != "" {
+		fileChecksum, err = computeChecksum(options.checksumAlgorithm, io.NewSectionReader(data, 0, size))
+		if err != nil {
+			return fmt.Errorf("failed to compute the checksum of the data file: %w", err)
+		}
+		setPutChecksum(input, options.checksumAlgorithm, fileChecksum)
+		input.Metadata = withChecksumMetadata(input.Metadata, options.checksumAlgorithm, fileChecksum)
+	}
+	if options.usesMultipart(size) {
+		err = c.multipartUpload(ctx, input, data, size, &options)
+	} else {
+		_, err = c.s3Client.PutObject(ctx, input)
+	}
+	// Whether this call wrote the data file, instead of finding the same file already uploaded
+	dataWritten := true
+	if err != nil && options.noOverwrite && isPreconditionFailed(err) {
+		err = c.checkExistingObject(ctx, file.fileName, err, metadataChecksumMatches(options.checksumAlgorithm, fileChecksum))
+		dataWritten = false
+	}
 	if err != nil {
 		return fmt.Errorf("failed to upload data file to s3: %w", err)
 	}
 
 	if withMetaFile {
 		// If requested, also upload the meta file:
-		metafileKey := file.MetaFileKey()
-		metafileBody, err := json.Marshal(file.indexes)
+		metaWritten, err := c.uploadMetaFile(ctx, file, tagging, &options, fileChecksum)
 		if err != nil {
-			return fmt.Errorf("failed to marshal meta body: %w", err)
+			if options.rollback {
+				return c.rollbackUpload(ctx, file, dataWritten, metaWritten, err)
+			}
+			return err
 		}
+	}
 
-		// Compress the metafile body with zstd
-		var compressedBuf bytes.Buffer
-		zstdWriter, err := zstd.NewWriter(&compressedBuf)
-		if err != nil {
-			return fmt.Errorf("failed to create zstd writer: %w", err)
-		}
-		_, err = zstdWriter.Write(metafileBody)
-		if err != nil {
-			return fmt.Errorf("failed to write to zstd writer: %w", err)
-		}
-		err = zstdWriter.Close()
+	return nil
+}
+
+// uploadMetaFile uploads the meta file of the given file, whose data file was uploaded with the given checksum.
+// It returns whether the meta file may have been written by this call, which is the case if it was uploaded, or if
+// the request failed without knowing its outcome, for example after a timeout.
+func (c *client[K]) uploadMetaFile(ctx context.Context, file *TempFile[K], tagging string, options *uploadOptions, fileChecksum string) (bool, error) {
+	metafileKey := file.MetaFileKey()
+	metaFile := newMetaFile(file, options.checksumAlgorithm, fileChecksum)
+	metafileBody, err := encodeMetaFile(metaFile, options.metaFileVersion, c.idCodec)
+	if err != nil {
+		return false, err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:  &c.s3Bucket,
+		Key:     &metafileKey,
+		Body:    bytes.NewReader(metafileBody),
+		Tagging: &tagging,
+	}
+	options.applyToPut(input)
+	options.applyConditionalWrite(input)
+	c.sseCustomerKey.applyToPut(input)
+	var metafileChecksum string
+	if options.checksumAlgorithm != "" {
+		metafileChecksum, err = computeChecksum(options.checksumAlgorithm, bytes.NewReader(metafileBody))
 		if err != nil {
-			return fmt.Errorf("failed to close zstd writer: %w", err)
+			return false, fmt.Errorf("failed to compute the checksum of the meta file: %w", err)
 		}
-
-		_, err = c.s3Client.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:  &c.s3Bucket,
-			Key:     &metafileKey,
-			Body:    bytes.NewReader(compressedBuf.Bytes()),
-			Tagging: &tagging,
-		})
+		setPutChecksum(input, options.checksumAlgorithm, metafileChecksum)
+		input.Metadata = withChecksumMetadata(input.Metadata, options.checksumAlgorithm, metafileChecksum)
+		input.Metadata[dataChecksumMetadataKey] = fileChecksum
+	}
+	_, err = c.s3Client.PutObject(ctx, input)
+	if err != nil && options.noOverwrite && isPreconditionFailed(err) {
+		// The meta file already existed, so this call didn't write it
+		err = c.checkExistingObject(ctx, metafileKey, err, metadataChecksumMatches(options.checksumAlgorithm, metafileChecksum))
 		if err != nil {
-			return fmt.Errorf("failed to upload meta file to s3: %w", err)
+			return false, fmt.Errorf("failed to upload meta file to s3: %w", err)
 		}
+		return false, nil
 	}
-
-	return nil
+	if err != nil {
+		return true, fmt.Errorf("failed to upload meta file to s3: %w", err)
+	}
+	return true, nil
 }
 
 func (c *client[K]) DeleteFile(ctx context.Context, file *TempFile[K]) error {
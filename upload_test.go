@@ -1,12 +1,14 @@
 package s3batchstore
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -76,11 +78,14 @@ func TestClient_UploadFile(t *testing.T) {
 					body, err := zstdReader.DecodeAll(compressedBody, nil)
 					g.Expect(err).ToNot(HaveOccurred())
 
-					g.Expect(body).To(MatchJSON(`{` +
+					g.Expect(body).To(MatchJSON(`{"header":{` +
+						`"version":2,"created_on":"` + file.createdOn.UTC().Format(time.RFC3339Nano) + `",` +
+						`"tags":{"retention-days":"14"},"count":3,"size":` + strconv.Itoa(int(file.Size())) + `,"key_type":"string"` +
+						`},"entries":{` +
 						`"1":{"file":"` + file.fileName + `","offset":0,"length":` + strconv.Itoa(compressedObjLengths[0]) + `},` +
 						`"3":{"file":"` + file.fileName + `","offset":` + strconv.Itoa(compressedObjLengths[0]) + `,"length":` + strconv.Itoa(compressedObjLengths[1]) + `},` +
 						`"6":{"file":"` + file.fileName + `","offset":` + strconv.Itoa(compressedObjLengths[0]+compressedObjLengths[1]) + `,"length":` + strconv.Itoa(compressedObjLengths[2]) + `}` +
-						`}`))
+						`}}`))
 					return &s3.PutObjectOutput{}, nil
 				})
 			},
@@ -152,11 +157,14 @@ func TestClient_UploadFile(t *testing.T) {
 					body, err := zstdReader.DecodeAll(compressedBody, nil)
 					g.Expect(err).ToNot(HaveOccurred())
 
-					g.Expect(body).To(MatchJSON(`{` +
+					g.Expect(body).To(MatchJSON(`{"header":{` +
+						`"version":2,"created_on":"` + file.createdOn.UTC().Format(time.RFC3339Nano) + `",` +
+						`"tags":{"retention-days":"14"},"count":3,"size":` + strconv.Itoa(int(file.Size())) + `,"key_type":"string"` +
+						`},"entries":{` +
 						`"1":{"file":"` + file.fileName + `","offset":0,"length":` + strconv.Itoa(compressedObjLengths[0]) + `},` +
 						`"3":{"file":"` + file.fileName + `","offset":` + strconv.Itoa(compressedObjLengths[0]) + `,"length":` + strconv.Itoa(compressedObjLengths[1]) + `},` +
 						`"6":{"file":"` + file.fileName + `","offset":` + strconv.Itoa(compressedObjLengths[0]+compressedObjLengths[1]) + `,"length":` + strconv.Itoa(compressedObjLengths[2]) + `}` +
-						`}`))
+						`}}`))
 					return nil, fmt.Errorf("s3 service error")
 				})
 			},
@@ -172,6 +180,7 @@ func TestClient_UploadFile(t *testing.T) {
 			s3Mock := mocks3.NewMockS3Client(ctrl)
 
 			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
 				s3Bucket: testBucketName,
 				s3Client: s3Mock,
 			}
@@ -201,6 +210,94 @@ func TestClient_UploadFile(t *testing.T) {
 	}
 }
 
+func TestClient_UploadFileWithOptions(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := &client[string]{
+		idCodec: StringKeyCodec[string](),
+		clientOptions: clientOptions{
+			uploadOpts: []UploadOption{WithStorageClass(types.StorageClassGlacierIr), WithSSES3()},
+		},
+		s3Bucket: testBucketName,
+		s3Client: s3Mock,
+	}
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("my first payload"))).To(Succeed())
+
+	expectCommonOptions := func(input *s3.PutObjectInput) {
+		g.Expect(*input.Bucket).To(Equal(testBucketName))
+		g.Expect(input.Tagging).To(Equal(aws.String("retention-days=14")))
+		g.Expect(input.StorageClass).To(Equal(types.StorageClassGlacierIr))
+		// The SSE-KMS option overrides the SSE-S3 default
+		g.Expect(input.ServerSideEncryption).To(Equal(types.ServerSideEncryptionAwsKms))
+		g.Expect(input.SSEKMSKeyId).To(Equal(aws.String("my-key")))
+		g.Expect(input.BucketKeyEnabled).To(Equal(aws.Bool(true)))
+		g.Expect(input.CacheControl).To(Equal(aws.String("max-age=3600")))
+		g.Expect(input.Metadata).To(Equal(map[string]string{"source": "test"}))
+		g.Expect(input.SSECustomerAlgorithm).To(BeNil())
+		g.Expect(input.IfNoneMatch).To(BeNil())
+	}
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.fileName)).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		expectCommonOptions(input)
+		g.Expect(input.ContentType).To(Equal(aws.String("application/x-ndjson")))
+		return &s3.PutObjectOutput{}, nil
+	})
+	s3Mock.EXPECT().PutObject(ctx, matchUploadParams(file.MetaFileKey())).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		expectCommonOptions(input)
+		g.Expect(input.ContentType).To(BeNil())
+		return &s3.PutObjectOutput{}, nil
+	})
+
+	err = c.UploadFile(ctx, file, true,
+		WithSSEKMS("my-key", true),
+		WithCacheControl("max-age=3600"),
+		WithContentType("application/x-ndjson"),
+		WithMetadata(map[string]string{"source": "test"}),
+	)
+	g.Expect(err).ToNot(HaveOccurred())
+}
+
+func TestClient_UploadFileSSECustomerKey(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	s3Mock := mocks3.NewMockS3Client(ctrl)
+
+	c := NewClient[string](aws.Config{}, testBucketName, WithSSECustomerKey(bytes.Repeat([]byte{0x01}, 32))).(*client[string])
+	c.s3Client = s3Mock
+
+	file, err := c.NewTempFile(testTags)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer func() { _ = file.Close() }()
+	g.Expect(file.Append("1", []byte("my first payload"))).To(Succeed())
+
+	// SSE-C can't be combined with the other server side encryptions, which fails before uploading anything
+	err = c.UploadFile(ctx, file, true, WithSSES3())
+	g.Expect(err).To(MatchError("server side encryption AES256 can't be combined with a customer provided key (SSE-C)"))
+	err = c.UploadFile(ctx, file, true, WithSSEKMS("my-key", false))
+	g.Expect(err).To(MatchError("server side encryption aws:kms can't be combined with a customer provided key (SSE-C)"))
+
+	s3Mock.EXPECT().PutObject(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		g.Expect(input.ServerSideEncryption).To(BeEmpty())
+		g.Expect(input.SSECustomerAlgorithm).To(Equal(aws.String("AES256")))
+		g.Expect(input.SSECustomerKey).To(Equal(aws.String("AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=")))
+		g.Expect(input.SSECustomerKeyMD5).To(Equal(aws.String("4Funlf7OsLF0HL+vKU+fkg==")))
+		return &s3.PutObjectOutput{}, nil
+	}).Times(2)
+	g.Expect(c.UploadFile(ctx, file, true)).To(Succeed())
+
+	// Only 256 bits keys are supported
+	g.Expect(func() { WithSSECustomerKey([]byte("too short")) }).To(PanicWith("s3batchstore: the SSE-C key must be 32 bytes long, got 9"))
+}
+
 func TestClient_DeleteFile(t *testing.T) {
 	g := NewGomegaWithT(t)
 
@@ -275,6 +372,7 @@ func TestClient_DeleteFile(t *testing.T) {
 			s3Mock := mocks3.NewMockS3Client(ctrl)
 
 			c := &client[string]{
+				idCodec:  StringKeyCodec[string](),
 				s3Bucket: testBucketName,
 				s3Client: s3Mock,
 			}